@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/go-errors/errors"
@@ -20,6 +22,9 @@ var (
 	dumpConfig  bool
 	serve       string
 	extract     string
+	sweep       bool
+	bundle      string
+	bundleKey   string
 )
 
 func init() {
@@ -28,13 +33,24 @@ func init() {
 	flag.BoolVar(&dumpConfig, "dump", false, "Dump the parsed config and exit")
 	flag.StringVar(&serve, "serve", "", "Serve a given zip from a local HTTP server")
 	flag.StringVar(&extract, "extract", "", "Extract zip file to random name on GCS (requires a config with bucket)")
+	flag.BoolVar(&sweep, "sweep-orphans", false, "Delete objects recorded in the orphan log and exit")
+	flag.StringVar(&bundle, "bundle", "", "Zip every object under a prefix of the bucket (requires -bundle-key)")
+	flag.StringVar(&bundleKey, "bundle-key", "", "Key to store the zip made with -bundle at")
 }
 
+// tracingShutdownTimeout bounds how long exiting waits for pending spans
+const tracingShutdownTimeout = 5 * time.Second
+
+// flushTracing sends pending spans, once tracing is set up. log.Fatal exits
+// without running deferred calls, so it must be called before.
+var flushTracing = func() {}
+
 func must(err error) {
 	if err == nil {
 		return
 	}
 
+	flushTracing()
 	if se, ok := err.(*errors.Error); ok {
 		log.Fatal(se.ErrorStack())
 	} else {
@@ -52,12 +68,57 @@ func main() {
 
 	config, err := zipserver.LoadConfig(configFname)
 	must(err)
+	must(zipserver.SetupLogging(config))
+
+	shutdownTracing, err := zipserver.SetupTracing(config)
+	must(err)
+
+	var flushOnce sync.Once
+	flushTracing = func() {
+		flushOnce.Do(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+			defer cancel()
+
+			if err := shutdownTracing(ctx); err != nil {
+				log.Println("Flushing traces failed:", err.Error())
+			}
+		})
+	}
+	defer flushTracing()
 
 	if dumpConfig {
 		fmt.Println(config)
 		return
 	}
 
+	if sweep {
+		result, err := zipserver.SweepOrphans(context.Background(), config)
+		must(err)
+
+		blob, _ := json.Marshal(result)
+		fmt.Println(string(blob))
+		return
+	}
+
+	if bundle != "" {
+		if bundleKey == "" {
+			log.Fatal("-bundle requires -bundle-key")
+		}
+
+		archiver := zipserver.NewArchiver(config)
+		limits := zipserver.DefaultExtractLimits(config)
+
+		result, err := archiver.Bundle(context.Background(), bundleKey, bundle, nil, limits)
+		must(err)
+
+		blob, _ := json.Marshal(struct {
+			Success bool
+			*zipserver.BundleResult
+		}{true, result})
+		fmt.Println(string(blob))
+		return
+	}
+
 	if extract != "" {
 		archiver := zipserver.NewArchiver(config)
 		limits := zipserver.DefaultExtractLimits(config)
@@ -74,9 +135,10 @@ func main() {
 			randChars[i] = letters[rand.Intn(len(letters))]
 		}
 
-		files, err := archiver.UploadZipFromFile(extract, string(randChars), limits)
+		files, err := archiver.UploadZipFromFile(context.Background(), extract, string(randChars), limits)
 
 		if err != nil {
+			flushTracing()
 			log.Fatal(err.Error())
 			return
 		}
@@ -91,5 +153,6 @@ func main() {
 	}
 
 	err = zipserver.StartZipServer(listenTo, config)
+	flushTracing()
 	must(err)
 }
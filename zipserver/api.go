@@ -0,0 +1,578 @@
+package zipserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// maxRequestBodySize caps JSON request bodies
+const maxRequestBodySize = 1024 * 1024
+
+// RequestError is a problem with the parameters of a request
+type RequestError struct {
+	Message string
+}
+
+func (re *RequestError) Error() string {
+	return re.Message
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &RequestError{fmt.Sprintf(format, args...)}
+}
+
+// LimitError is returned when a zip or a file goes over the limits set for
+// its extraction or slurp
+type LimitError struct {
+	Message string
+}
+
+func (le *LimitError) Error() string {
+	return le.Message
+}
+
+func limitExceeded(format string, args ...interface{}) error {
+	return &LimitError{fmt.Sprintf(format, args...)}
+}
+
+// statusClientClosedRequest is nginx's non-standard status for requests
+// given up on by the client, there's no standard one
+const statusClientClosedRequest = 499
+
+// statusCodeFor picks the HTTP status reporting err
+func statusCodeFor(err error) int {
+	var re *RequestError
+	var le *LimitError
+	var te *TimeoutError
+	var se *StorageError
+
+	switch {
+	case errors.As(err, &re):
+		return http.StatusBadRequest
+	case errors.As(err, &le), errors.Is(err, errChecksumMismatch):
+		return http.StatusUnprocessableEntity
+	case errors.As(err, &te):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, errMethodNotAllowed):
+		return http.StatusMethodNotAllowed
+	case errors.Is(err, errShuttingDown):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, errUnknownJob), errors.Is(err, errNoRunningJob), errors.Is(err, errNoSuchEntry):
+		return http.StatusNotFound
+	case errors.Is(err, errCanceled), errors.Is(err, errClientGone):
+		return statusClientClosedRequest
+	case errors.As(err, &se):
+		switch se.Kind {
+		case StorageNotFound:
+			return http.StatusNotFound
+		case StorageTransient:
+			return http.StatusServiceUnavailable
+		default:
+			// storage is upstream of us
+			return http.StatusBadGateway
+		}
+	}
+
+	return http.StatusInternalServerError
+}
+
+// CallbackParams configures how an async job reports back
+type CallbackParams struct {
+	// URL the result is posted to. If set, the job runs in the background
+	// and the request returns right away
+	URL string
+	// Seconds between progress notifications to URL, 0 for none
+	ProgressInterval int
+}
+
+// LimitsParams overrides the extraction limits and timeouts set in the
+// config, fields left out keep their configured value
+type LimitsParams struct {
+	MaxFileSize       *uint64
+	MaxTotalSize      *uint64
+	MaxNumFiles       *int
+	MaxFileNameLength *int
+
+	// In seconds, 0 means no limit
+	JobTimeout      *int
+	DownloadTimeout *int
+	FileTimeout     *int
+}
+
+// limits returns the configured limits, overridden by lp
+func (lp *LimitsParams) limits(config *Config) *ExtractLimits {
+	limits := DefaultExtractLimits(config)
+
+	if lp.MaxFileSize != nil {
+		limits.MaxFileSize = *lp.MaxFileSize
+	}
+	if lp.MaxTotalSize != nil {
+		limits.MaxTotalSize = *lp.MaxTotalSize
+	}
+	if lp.MaxNumFiles != nil {
+		limits.MaxNumFiles = *lp.MaxNumFiles
+	}
+	if lp.MaxFileNameLength != nil {
+		limits.MaxFileNameLength = *lp.MaxFileNameLength
+	}
+	if lp.JobTimeout != nil {
+		limits.JobTimeout = seconds(*lp.JobTimeout)
+	}
+	if lp.DownloadTimeout != nil {
+		limits.DownloadTimeout = seconds(*lp.DownloadTimeout)
+	}
+	if lp.FileTimeout != nil {
+		limits.FileTimeout = seconds(*lp.FileTimeout)
+	}
+
+	return limits
+}
+
+// ExtractRequest is the JSON body of POST /extract
+type ExtractRequest struct {
+	// Key of the zip in the bucket
+	Key string
+	// Where to extract it, under the configured ExtractPrefix
+	Prefix string
+	// Only extract these files of the zip, all of them if empty
+	Files    []string
+	Limits   LimitsParams
+	Callback CallbackParams
+}
+
+// SlurpExtractRequest is the JSON body of POST /slurp/extract
+type SlurpExtractRequest struct {
+	// URL to download the zip from
+	URL string
+	// Headers sent when downloading URL
+	Headers map[string]string
+	// Also store the zip under this key, if set
+	Key string
+	// Where to extract it, under the configured ExtractPrefix
+	Prefix string
+	// Only extract these files of the zip, all of them if empty
+	Files []string
+	// Fail if the zip is larger than this, defaults to and can't exceed the
+	// configured MaxInputZipSize
+	MaxBytes uint64
+	Limits   LimitsParams
+	Callback CallbackParams
+}
+
+// maxBytes is the size the zip may have, MaxBytes capped by config
+func (req *SlurpExtractRequest) maxBytes(config *Config) uint64 {
+	if req.MaxBytes == 0 || (config.MaxInputZipSize > 0 && req.MaxBytes > config.MaxInputZipSize) {
+		return config.MaxInputZipSize
+	}
+	return req.MaxBytes
+}
+
+// BundleRequest is the JSON body of POST /bundle
+type BundleRequest struct {
+	// Key the zip is stored at
+	Key string
+	// Objects to bundle, named in the zip by their key relative to Prefix
+	Prefix string
+	// Only bundle these keys, relative to Prefix, instead of everything
+	// under it
+	Files    []string
+	Limits   LimitsParams
+	Callback CallbackParams
+}
+
+// DownloadRequest is the JSON body of POST /download
+type DownloadRequest struct {
+	// Objects to zip, named in the zip by their key relative to Prefix
+	Prefix string
+	// Only zip these keys, relative to Prefix
+	Files []string
+	// Name of the zip for the browser, defaults to the last part of Prefix
+	Filename string
+	Limits   LimitsParams
+}
+
+// EntryRequest is the JSON body of POST /entry
+type EntryRequest struct {
+	// Key of the zip in the bucket
+	Key string
+	// Path of the file in the zip
+	File string
+}
+
+// SlurpRequest is the JSON body of POST /slurp
+type SlurpRequest struct {
+	// Key to store the file under
+	Key string
+	// URL to download the file from
+	URL string
+	// Headers sent when downloading URL
+	Headers map[string]string
+
+	// Stored along with the file, ContentType defaults to whatever URL
+	// responded with
+	ContentType        string
+	ContentDisposition string
+	ACL                string
+	// Custom metadata, stored as x-goog-meta-* headers
+	Metadata map[string]string
+
+	// Fail if the file is larger than this, 0 means no limit
+	MaxBytes uint64
+	// Digests the file is expected to have, in hex or base64. If it doesn't
+	// match, the slurp fails before anything is stored
+	Checksums Digests
+	// Connections to download the file over if the server supports range
+	// requests, defaults to the configured SlurpConnections
+	Connections *int
+	// In seconds, 0 means no limit
+	Timeout         *int
+	DownloadTimeout *int
+
+	Callback CallbackParams
+}
+
+// ListRequest is the JSON body of POST /list, one of Key or URL is required
+type ListRequest struct {
+	// Key of the zip in the bucket
+	Key string
+	// URL to download the zip from
+	URL string
+	// Describe each entry in full instead of just its name and size
+	Details bool
+	// With Details, the prefix extraction would be to, to report the key
+	// each entry would be stored under
+	Prefix string
+
+	// Only list files whose path starts with PathPrefix and that match Glob.
+	// Globs without a slash match file names, wherever they are
+	PathPrefix string
+	Glob       string
+	// One of name, size or modified, prefixed with - to reverse it. Files
+	// are listed in zip order by default
+	Sort string
+	// files (the default), directories to sum up files by directory, or tree
+	Format string
+	// Paginate, listing at most Limit entries from Cursor, the NextCursor
+	// of the previous page
+	Limit  int
+	Cursor string
+}
+
+// decodeJSONRequest fills req from the body of r if it's a JSON POST. It
+// returns false if it isn't, in which case the query string should be used.
+func decodeJSONRequest(r *http.Request, req interface{}) (bool, error) {
+	if r.Method != http.MethodPost {
+		return false, nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return false, nil
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxRequestBodySize))
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(req)
+	if err != nil {
+		return true, badRequest("Invalid JSON body: %s", err.Error())
+	}
+
+	return true, nil
+}
+
+var errMethodNotAllowed = errors.New("Method not allowed")
+
+// requirePost fails for requests that aren't POSTs, for endpoints with side
+// effects that mustn't be triggered by a crawler or a prefetch
+func requirePost(w http.ResponseWriter, r *http.Request) error {
+	if r.Method == http.MethodPost {
+		return nil
+	}
+
+	w.Header().Set("Allow", http.MethodPost)
+	return fmt.Errorf("%w: %s", errMethodNotAllowed, r.Method)
+}
+
+func missingParam(name string) error {
+	return badRequest("Missing param %v", name)
+}
+
+// queryLimitsParams reads limits from the query string, ignoring invalid values
+func queryLimitsParams(params url.Values) LimitsParams {
+	lp := LimitsParams{}
+
+	uint64Param := func(name string) *uint64 {
+		if val, err := getUint64Param(params, name); err == nil {
+			return &val
+		}
+		return nil
+	}
+
+	intParam := func(name string) *int {
+		if val, err := getIntParam(params, name); err == nil {
+			return &val
+		}
+		return nil
+	}
+
+	lp.MaxFileSize = uint64Param("maxFileSize")
+	lp.MaxTotalSize = uint64Param("maxTotalSize")
+	lp.MaxNumFiles = intParam("maxNumFiles")
+	lp.MaxFileNameLength = intParam("maxFileNameLength")
+	lp.JobTimeout = intParam("jobTimeout")
+	lp.DownloadTimeout = intParam("downloadTimeout")
+	lp.FileTimeout = intParam("fileTimeout")
+
+	return lp
+}
+
+func parseExtractRequest(r *http.Request) (*ExtractRequest, error) {
+	req := &ExtractRequest{}
+
+	isJSON, err := decodeJSONRequest(r, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isJSON {
+		params := r.URL.Query()
+		req.Key = params.Get("key")
+		req.Prefix = params.Get("prefix")
+		req.Files = params["file"]
+		req.Limits = queryLimitsParams(params)
+		req.Callback.URL = params.Get("async")
+		if interval, err := getIntParam(params, "progressInterval"); err == nil {
+			req.Callback.ProgressInterval = interval
+		}
+	}
+
+	if req.Key == "" {
+		return nil, missingParam("key")
+	}
+
+	if req.Prefix == "" {
+		return nil, missingParam("prefix")
+	}
+
+	return req, nil
+}
+
+func parseSlurpRequest(r *http.Request) (*SlurpRequest, error) {
+	req := &SlurpRequest{}
+
+	isJSON, err := decodeJSONRequest(r, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isJSON {
+		params := r.URL.Query()
+		req.Key = params.Get("key")
+		req.URL = params.Get("url")
+		req.ContentType = params.Get("content_type")
+		req.ContentDisposition = params.Get("content_disposition")
+		req.ACL = params.Get("acl")
+		req.Callback.URL = params.Get("async")
+
+		if params.Get("max_bytes") != "" {
+			req.MaxBytes, err = getUint64Param(params, "max_bytes")
+			if err != nil {
+				return nil, badRequest("Invalid max_bytes: %s", err.Error())
+			}
+		}
+
+		if timeout, err := getIntParam(params, "timeout"); err == nil {
+			req.Timeout = &timeout
+		}
+
+		if timeout, err := getIntParam(params, "download_timeout"); err == nil {
+			req.DownloadTimeout = &timeout
+		}
+
+		if connections, err := getIntParam(params, "connections"); err == nil {
+			req.Connections = &connections
+		}
+
+		req.Checksums.SHA256 = params.Get("sha256")
+		req.Checksums.MD5 = params.Get("md5")
+		req.Checksums.CRC32C = params.Get("crc32c")
+	}
+
+	err = req.Checksums.normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Key == "" {
+		return nil, missingParam("key")
+	}
+
+	if req.URL == "" {
+		return nil, missingParam("url")
+	}
+
+	return req, nil
+}
+
+func parseSlurpExtractRequest(r *http.Request) (*SlurpExtractRequest, error) {
+	req := &SlurpExtractRequest{}
+
+	isJSON, err := decodeJSONRequest(r, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isJSON {
+		params := r.URL.Query()
+		req.URL = params.Get("url")
+		req.Key = params.Get("key")
+		req.Prefix = params.Get("prefix")
+		req.Files = params["file"]
+		req.Limits = queryLimitsParams(params)
+		req.Callback.URL = params.Get("async")
+
+		if params.Get("max_bytes") != "" {
+			req.MaxBytes, err = getUint64Param(params, "max_bytes")
+			if err != nil {
+				return nil, badRequest("Invalid max_bytes: %s", err.Error())
+			}
+		}
+	}
+
+	if req.URL == "" {
+		return nil, missingParam("url")
+	}
+
+	if req.Prefix == "" {
+		return nil, missingParam("prefix")
+	}
+
+	return req, nil
+}
+
+func parseBundleRequest(r *http.Request) (*BundleRequest, error) {
+	req := &BundleRequest{}
+
+	isJSON, err := decodeJSONRequest(r, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isJSON {
+		params := r.URL.Query()
+		req.Key = params.Get("key")
+		req.Prefix = params.Get("prefix")
+		req.Files = params["file"]
+		req.Limits = queryLimitsParams(params)
+		req.Callback.URL = params.Get("async")
+	}
+
+	if req.Key == "" {
+		return nil, missingParam("key")
+	}
+
+	if req.Prefix == "" && len(req.Files) == 0 {
+		return nil, badRequest("missing prefix or file")
+	}
+
+	return req, nil
+}
+
+func parseDownloadRequest(r *http.Request) (*DownloadRequest, error) {
+	req := &DownloadRequest{}
+
+	isJSON, err := decodeJSONRequest(r, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isJSON {
+		params := r.URL.Query()
+		req.Prefix = params.Get("prefix")
+		req.Files = params["file"]
+		req.Filename = params.Get("filename")
+		req.Limits = queryLimitsParams(params)
+	}
+
+	if req.Prefix == "" && len(req.Files) == 0 {
+		return nil, badRequest("missing prefix or file")
+	}
+
+	if req.Filename == "" {
+		req.Filename = path.Base(strings.TrimSuffix(req.Prefix, "/")) + ".zip"
+	}
+
+	return req, nil
+}
+
+func parseEntryRequest(r *http.Request) (*EntryRequest, error) {
+	req := &EntryRequest{}
+
+	isJSON, err := decodeJSONRequest(r, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isJSON {
+		params := r.URL.Query()
+		req.Key = params.Get("key")
+		req.File = params.Get("file")
+	}
+
+	if req.Key == "" {
+		return nil, missingParam("key")
+	}
+
+	if req.File == "" {
+		return nil, missingParam("file")
+	}
+
+	return req, nil
+}
+
+func parseListRequest(r *http.Request) (*ListRequest, error) {
+	req := &ListRequest{}
+
+	isJSON, err := decodeJSONRequest(r, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isJSON {
+		params := r.URL.Query()
+		req.Key = params.Get("key")
+		req.URL = params.Get("url")
+		req.Details = params.Get("details") == "true"
+		req.Prefix = params.Get("prefix")
+		req.PathPrefix = params.Get("pathPrefix")
+		req.Glob = params.Get("glob")
+		req.Sort = params.Get("sort")
+		req.Format = params.Get("format")
+		req.Cursor = params.Get("cursor")
+
+		if params.Get("limit") != "" {
+			req.Limit, err = getIntParam(params, "limit")
+			if err != nil {
+				return nil, badRequest("Invalid limit: %s", err.Error())
+			}
+		}
+	}
+
+	if req.Key == "" && req.URL == "" {
+		return nil, badRequest("missing key or url")
+	}
+
+	err = req.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
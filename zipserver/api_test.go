@@ -0,0 +1,117 @@
+package zipserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	goerrors "github.com/go-errors/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_StatusCodes(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+	}{
+		{errors.New("oh no"), http.StatusInternalServerError},
+		{missingParam("key"), http.StatusBadRequest},
+		{goerrors.Wrap(limitExceeded("Too many files"), 0), http.StatusUnprocessableEntity},
+		{fmt.Errorf("Extraction aborted: %w", &TimeoutError{"extraction", time.Second}), http.StatusGatewayTimeout},
+		{errShuttingDown, http.StatusServiceUnavailable},
+		{fmt.Errorf("%w: GET", errMethodNotAllowed), http.StatusMethodNotAllowed},
+		{fmt.Errorf("%w: abc", errUnknownJob), http.StatusNotFound},
+		{fmt.Errorf("Extraction aborted: %w", errCanceled), statusClientClosedRequest},
+		{fmt.Errorf("Slurp aborted: %w", errClientGone), statusClientClosedRequest},
+		{goerrors.Wrap(newStorageError(404, "404 Not Found", "url"), 0), http.StatusNotFound},
+		{newStorageError(503, "503 Service Unavailable", "url"), http.StatusServiceUnavailable},
+		{newStorageError(403, "403 Forbidden", "url"), http.StatusBadGateway},
+	}
+
+	for _, c := range cases {
+		assert.EqualValues(t, c.status, statusCodeFor(c.err), c.err.Error())
+	}
+}
+
+func Test_JSONRequests(t *testing.T) {
+	post := func(body string) *http.Request {
+		req := httptest.NewRequest("POST", "/extract", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		return req
+	}
+
+	req, err := parseExtractRequest(post(`{
+		"Key": "zips/my_file.zip",
+		"Prefix": "extracted",
+		"Limits": {"MaxNumFiles": 10, "JobTimeout": 0},
+		"Callback": {"URL": "http://localhost/done", "ProgressInterval": 5}
+	}`))
+	assert.NoError(t, err)
+	assert.EqualValues(t, "zips/my_file.zip", req.Key)
+	assert.EqualValues(t, "extracted", req.Prefix)
+	assert.EqualValues(t, "http://localhost/done", req.Callback.URL)
+	assert.EqualValues(t, 5, req.Callback.ProgressInterval)
+
+	limits := req.Limits.limits(&defaultConfig)
+	assert.EqualValues(t, 10, limits.MaxNumFiles)
+	assert.EqualValues(t, 0, limits.JobTimeout, "explicit zeroes override the config")
+	assert.EqualValues(t, defaultConfig.MaxFileSize, limits.MaxFileSize)
+
+	// the query string still works, and gives the same result
+	queryReq, err := parseExtractRequest(httptest.NewRequest("GET",
+		"/extract?key=zips/my_file.zip&prefix=extracted&maxNumFiles=10&jobTimeout=0&async=http://localhost/done&progressInterval=5", nil))
+	assert.NoError(t, err)
+	assert.EqualValues(t, req, queryReq)
+
+	_, err = parseExtractRequest(post(`{"Key": "zips/my_file.zip"}`))
+	assert.EqualError(t, err, "Missing param prefix")
+
+	_, err = parseExtractRequest(post(`{"Key": "zips/my_file.zip", "Prefx": "typo"}`))
+	assert.Error(t, err)
+	assert.EqualValues(t, http.StatusBadRequest, statusCodeFor(err))
+
+	_, err = parseExtractRequest(post(`{"Key": `))
+	assert.Error(t, err)
+	assert.EqualValues(t, http.StatusBadRequest, statusCodeFor(err))
+
+	slurpReq, err := parseSlurpRequest(post(`{
+		"Key": "uploads/file.zip",
+		"URL": "http://example.org/file.zip",
+		"Headers": {"Authorization": "Bearer abc"},
+		"Metadata": {"uploader": "123"},
+		"MaxBytes": 1024
+	}`))
+	assert.NoError(t, err)
+	assert.EqualValues(t, "Bearer abc", slurpReq.Headers["Authorization"])
+	assert.EqualValues(t, "123", slurpReq.Metadata["uploader"])
+	assert.EqualValues(t, 1024, slurpReq.MaxBytes)
+
+	_, err = parseSlurpRequest(httptest.NewRequest("GET", "/slurp?key=a&url=b&max_bytes=lots", nil))
+	assert.Error(t, err)
+	assert.EqualValues(t, http.StatusBadRequest, statusCodeFor(err))
+
+	_, err = parseListRequest(post(`{}`))
+	assert.EqualError(t, err, "missing key or url")
+}
+
+func Test_RequestErrorResponses(t *testing.T) {
+	handler := errorHandler(extractHandler)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/extract?prefix=extracted", nil))
+	assert.EqualValues(t, http.StatusBadRequest, rec.Code)
+	assert.EqualValues(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var response struct {
+		Type  string
+		Error string
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.EqualValues(t, "RequestError", response.Type)
+	assert.EqualValues(t, "Missing param key", response.Error)
+}
@@ -2,20 +2,21 @@ package zipserver
 
 import (
 	"bytes"
-	"crypto/md5"
-	"encoding/hex"
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"mime"
-	"net/http"
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"time"
 
 	"archive/zip"
 
 	errors "github.com/go-errors/errors"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var (
@@ -44,24 +45,22 @@ type ExtractedFile struct {
 
 // NewArchiver creates a new archiver from the given config
 func NewArchiver(config *Config) *Archiver {
-	storage, err := NewGcsStorage(config)
+	storage, err := newStorage(config)
 
 	if storage == nil {
-		log.Fatal("Failed to create storage:", err)
+		log.Fatal("Failed to create storage: ", err)
 	}
 
 	return &Archiver{storage, config}
 }
 
-func (a *Archiver) fetchZip(key string) (string, error) {
-	os.MkdirAll(tmpDir, os.ModeDir|0777)
+func (a *Archiver) fetchZip(ctx context.Context, key string) (_ string, err error) {
+	ctx, span := startSpan(ctx, "Archiver.fetchZip", attribute.String("zip.key", key))
+	defer func() { endSpan(span, err) }()
 
-	hasher := md5.New()
-	hasher.Write([]byte(key))
-	fname := a.Bucket + "_" + hex.EncodeToString(hasher.Sum(nil)) + ".zip"
-	fname = path.Join(tmpDir, fname)
+	os.MkdirAll(tmpDir, os.ModeDir|0777)
 
-	src, err := a.Storage.GetFile(a.Bucket, key)
+	src, err := a.Storage.GetFile(ctx, a.Bucket, key)
 
 	if err != nil {
 		return "", errors.Wrap(err, 0)
@@ -69,7 +68,9 @@ func (a *Archiver) fetchZip(key string) (string, error) {
 
 	defer src.Close()
 
-	dest, err := os.Create(fname)
+	// the same zip may be extracted to several prefixes at once, each
+	// extraction gets its own copy
+	dest, err := os.CreateTemp(tmpDir, "*.zip")
 
 	if err != nil {
 		return "", errors.Wrap(err, 0)
@@ -77,22 +78,77 @@ func (a *Archiver) fetchZip(key string) (string, error) {
 
 	defer dest.Close()
 
-	_, err = io.Copy(dest, src)
+	written, err := io.Copy(dest, contextReader(ctx, src))
+	metrics.downloadedBytes.WithLabelValues("extract").Add(float64(written))
+	span.SetAttributes(attribute.Int64("zip.size", written))
 	if err != nil {
+		os.Remove(dest.Name())
 		return "", errors.Wrap(err, 0)
 	}
 
-	return fname, nil
+	return dest.Name(), nil
 }
 
-// delete all files that have been uploaded so far
-func (a *Archiver) abortUpload(files []ExtractedFile) error {
-	for _, file := range files {
-		// FIXME: code quality - what if we fail here? any retry strategies?
-		a.Storage.DeleteFile(a.Bucket, file.Key)
+// cleanupTimeout bounds how long an aborted extraction spends deleting what
+// it uploaded, it has to fit in abortGracePeriod on shutdown
+const cleanupTimeout = 20 * time.Second
+
+// abortUpload deletes everything an aborted extraction may have uploaded,
+// using as many workers as the extraction itself. The storage already retries
+// failed deletes: objects that still can't be deleted are recorded as orphans.
+func (a *Archiver) abortUpload(ctx context.Context, keys []string) {
+	// ctx is likely canceled, that's often why we're aborting
+	ctx, cancel := context.WithTimeout(detachContext(ctx), cleanupTimeout)
+	defer cancel()
+
+	loggerFrom(ctx).Infof("Deleting %d uploaded files", len(keys))
+
+	threads := a.ExtractionThreads
+	if threads < 1 {
+		threads = 1
 	}
 
-	return nil
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	orphans := []Orphan{}
+	pending := make(chan string)
+
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range pending {
+				err := a.Storage.DeleteFile(ctx, a.Bucket, key)
+				// the upload may have failed before creating anything
+				if err == nil || isStorageNotFound(err) {
+					continue
+				}
+
+				mutex.Lock()
+				orphans = append(orphans, Orphan{
+					Bucket:     a.Bucket,
+					Key:        key,
+					JobID:      jobIDFrom(ctx),
+					Error:      err.Error(),
+					RecordedAt: time.Now().UTC(),
+				})
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	for _, key := range keys {
+		pending <- key
+	}
+	close(pending)
+	wg.Wait()
+
+	if len(orphans) > 0 {
+		err := recordOrphans(ctx, a.OrphanLogPath, orphans)
+		if err != nil {
+			loggerFrom(ctx).Errorf("Failed to record orphans: %s", err.Error())
+		}
+	}
 }
 
 func shouldIgnoreFile(fname string) bool {
@@ -127,23 +183,29 @@ type UploadFileTask struct {
 
 // UploadFileResult is successful is Error is nil - in that case, it contains the
 // GCS key the file was uploaded under, and the number of bytes written for that file.
+// Failed results carry the key the upload was attempted to, if any.
 type UploadFileResult struct {
 	Error error
 	Key   string
 	Size  uint64
 }
 
-func uploadWorker(a *Archiver, limits *ExtractLimits, tasks <-chan UploadFileTask, results chan<- UploadFileResult, cancel chan struct{}, done chan struct{}) {
+func uploadWorker(ctx context.Context, a *Archiver, limits *ExtractLimits, tasks <-chan UploadFileTask, results chan<- UploadFileResult, done chan struct{}) {
 	defer func() { done <- struct{}{} }()
 
 	for task := range tasks {
 		file := task.File
 		key := task.Key
 
-		resource, err := a.extractAndUploadOne(key, file, limits)
+		resource, err := a.extractAndUploadOne(ctx, key, file, limits)
 
 		if err != nil {
-			log.Print("Failed sending " + key + ": " + err.Error())
+			loggerFrom(ctx).Errorf("Failed sending %s: %s", key, err.Error())
+			// the upload may have gotten through regardless, report the key
+			// it went to so it gets cleaned up
+			if resource != nil {
+				key = resource.key
+			}
 			results <- UploadFileResult{err, key, 0}
 			return
 		}
@@ -152,60 +214,81 @@ func uploadWorker(a *Archiver, limits *ExtractLimits, tasks <-chan UploadFileTas
 	}
 }
 
-// extracts and sends all files to prefix
-func (a *Archiver) sendZipExtracted(prefix, fname string, limits *ExtractLimits) ([]ExtractedFile, error) {
+// extracts and sends all files to prefix, stops early if ctx is canceled
+func (a *Archiver) sendZipExtracted(ctx context.Context, prefix, fname string, limits *ExtractLimits) (_ []ExtractedFile, err error) {
+	ctx, span := startSpan(ctx, "Archiver.sendZipExtracted", attribute.String("extract.prefix", prefix))
+	defer func() { endSpan(span, err) }()
+
 	zipReader, err := zip.OpenReader(fname)
 	if err != nil {
 		return nil, errors.Wrap(err, 0)
 	}
+	defer zipReader.Close()
+
+	candidates := zipReader.File
+	if len(limits.OnlyFiles) > 0 {
+		candidates, err = selectZipEntries(&zipReader.Reader, limits.OnlyFiles)
+		if err != nil {
+			return nil, errors.Wrap(err, 0)
+		}
+	}
 
-	if len(zipReader.File) > limits.MaxNumFiles {
-		err := fmt.Errorf("Too many files in zip (%v > %v)",
-			len(zipReader.File), limits.MaxNumFiles)
+	if len(candidates) > limits.MaxNumFiles {
+		err := limitExceeded("Too many files in zip (%v > %v)",
+			len(candidates), limits.MaxNumFiles)
 		return nil, errors.Wrap(err, 0)
 	}
 
 	extractedFiles := []ExtractedFile{}
 
-	defer zipReader.Close()
-
 	fileCount := 0
 	var byteCount uint64
 
 	fileList := []*zip.File{}
 
-	for _, file := range zipReader.File {
+	events := eventsFrom(ctx)
+
+	for _, file := range candidates {
 		if shouldIgnoreFile(file.Name) {
+			events.publish("skipped", FileEvent{File: file.Name})
 			continue
 		}
 
 		if len(file.Name) > limits.MaxFileNameLength {
-			err := fmt.Errorf("Zip contains file paths that are too long")
+			err := limitExceeded("Zip contains file paths that are too long")
 			return nil, errors.Wrap(err, 0)
 		}
 
 		if file.UncompressedSize64 > limits.MaxFileSize {
-			err := fmt.Errorf("Zip contains file that is too large (%s)", file.Name)
+			err := limitExceeded("Zip contains file that is too large (%s)", file.Name)
 			return nil, errors.Wrap(err, 0)
 		}
 
 		byteCount += file.UncompressedSize64
 
 		if byteCount > limits.MaxTotalSize {
-			err := fmt.Errorf("Extracted zip too large (max %v bytes)", limits.MaxTotalSize)
+			err := limitExceeded("Extracted zip too large (max %v bytes)", limits.MaxTotalSize)
 			return nil, errors.Wrap(err, 0)
 		}
 
 		fileList = append(fileList, file)
 	}
 
+	progress := progressFrom(ctx)
+	progress.setTotals(len(fileList), byteCount)
+
 	tasks := make(chan UploadFileTask)
 	results := make(chan UploadFileResult)
-	cancel := make(chan struct{})
 	done := make(chan struct{}, limits.ExtractionThreads)
 
+	// canceled when anything goes wrong, which stops dispatching tasks and
+	// interrupts uploads in flight
+	parentCtx := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	for i := 0; i < limits.ExtractionThreads; i++ {
-		go uploadWorker(a, limits, tasks, results, cancel, done)
+		go uploadWorker(ctx, a, limits, tasks, results, done)
 	}
 
 	activeWorkers := limits.ExtractionThreads
@@ -217,7 +300,7 @@ func (a *Archiver) sendZipExtracted(prefix, fname string, limits *ExtractLimits)
 			task := UploadFileTask{file, key}
 			select {
 			case tasks <- task:
-			case <-cancel:
+			case <-ctx.Done():
 				// Something went wrong!
 				return
 			}
@@ -225,16 +308,43 @@ func (a *Archiver) sendZipExtracted(prefix, fname string, limits *ExtractLimits)
 	}()
 
 	var extractError error
+	// every key we tried uploading to, failed ones included: that's what
+	// has to be deleted if we abort
+	attemptedKeys := []string{}
+
+	abort := func(err error) {
+		// only the first error is reported, uploads failing because of
+		// the cancelation are just noise
+		if extractError == nil {
+			extractError = err
+			cancel()
+		}
+	}
+
+	aborted := parentCtx.Done()
 
 	for activeWorkers > 0 {
 		select {
+		case <-aborted:
+			// stop selecting on it, it'd fire again every iteration
+			aborted = nil
+			abort(abortedError(parentCtx))
 		case result := <-results:
-			if result.Error != nil {
-				extractError = result.Error
-				close(cancel)
+			attemptedKeys = append(attemptedKeys, result.Key)
+			if result.Error != nil && parentCtx.Err() != nil {
+				// the upload was interrupted because we're aborted, say why
+				abort(abortedError(parentCtx))
+			} else if result.Error != nil {
+				if extractError == nil {
+					// later failures are just uploads we interrupted
+					events.publish("failed", FileEvent{Key: result.Key, Error: result.Error.Error()})
+				}
+				abort(result.Error)
 			} else {
 				extractedFiles = append(extractedFiles, ExtractedFile{result.Key, result.Size})
 				fileCount++
+				progress.fileDone()
+				events.publish("uploaded", FileEvent{Key: result.Key, Size: result.Size})
 			}
 		case <-done:
 			activeWorkers--
@@ -244,103 +354,110 @@ func (a *Archiver) sendZipExtracted(prefix, fname string, limits *ExtractLimits)
 	close(results)
 
 	if extractError != nil {
-		log.Printf("Upload error: %s", extractError.Error())
-		a.abortUpload(extractedFiles)
+		loggerFrom(ctx).Errorf("Upload error: %s", extractError.Error())
+		// all workers are done, nothing else can get uploaded
+		a.abortUpload(ctx, attemptedKeys)
 		return nil, extractError
 	}
 
-	log.Printf("Sent %d files", fileCount)
+	loggerFrom(ctx).Infof("Sent %d files", fileCount)
+	span.SetAttributes(attribute.Int("extract.files", fileCount))
+	metrics.filesPerExtraction.Observe(float64(fileCount))
 	return extractedFiles, nil
 }
 
+// abortedError describes why the extraction running with ctx was aborted
+func abortedError(ctx context.Context) error {
+	return errors.Wrap(fmt.Errorf("Extraction aborted: %w", abortReason(ctx)), 0)
+}
+
 // sends an individual file from a zip
-func (a *Archiver) extractAndUploadOne(key string, file *zip.File, limits *ExtractLimits) (*ResourceSpec, error) {
+func (a *Archiver) extractAndUploadOne(ctx context.Context, key string, file *zip.File, limits *ExtractLimits) (_ *ResourceSpec, err error) {
+	ctx, span := startSpan(ctx, "Archiver.extractAndUploadOne",
+		attribute.String("zip.entry", file.Name),
+		attribute.Int64("zip.entry.size", int64(file.UncompressedSize64)),
+	)
+	defer func() { endSpan(span, err) }()
+
 	readerCloser, err := file.Open()
 	if err != nil {
 		return nil, err
 	}
-	defer readerCloser.Close()
+	// retries may reopen the entry, close whichever is open last
+	defer func() { readerCloser.Close() }()
 
 	var reader io.Reader = readerCloser
 
-	resource := &ResourceSpec{
-		key: key,
-	}
-
-	// try determining MIME by extension
-	mimeType := mime.TypeByExtension(path.Ext(key))
-
+	// the first bytes tell us about the content
 	var buffer bytes.Buffer
-	_, err = io.Copy(&buffer, io.LimitReader(reader, 512))
+	_, err = io.Copy(&buffer, io.LimitReader(reader, sniffLen))
 
 	if err != nil {
 		return nil, errors.Wrap(err, 0)
 	}
 
-	contentMimeType := http.DetectContentType(buffer.Bytes())
+	resource := newResourceSpec(key, buffer.Bytes())
 	// join the bytes read and the original reader
 	reader = io.MultiReader(&buffer, reader)
 
-	if contentMimeType == "application/x-gzip" || contentMimeType == "application/gzip" {
-		resource.contentEncoding = "gzip"
-
-		// try to see if there's a real extension hidden beneath
-		if strings.HasSuffix(key, ".gz") {
-			realMimeType := mime.TypeByExtension(path.Ext(strings.TrimSuffix(key, ".gz")))
-
-			if realMimeType != "" {
-				mimeType = realMimeType
-			}
-		}
+	loggerFrom(ctx).Infof("Sending: %s", resource)
+	span.SetAttributes(
+		attribute.String("storage.key", resource.key),
+		attribute.String("http.content_type", resource.contentType),
+		attribute.String("http.content_encoding", resource.contentEncoding),
+	)
 
-	} else if strings.HasSuffix(key, ".br") {
-		// there is no way to detect a brotli stream by content, so we assume if it ends if .br then it's brotli
-		// this path is used for Unity 2020 webgl games built with brotli compression
-		resource.contentEncoding = "br"
-		realMimeType := mime.TypeByExtension(path.Ext(strings.TrimSuffix(key, ".br")))
+	current := readerClosure(func(p []byte) (int, error) { return reader.Read(p) })
+	limited := progressReader(limitedReader(current, file.UncompressedSize64, &resource.size), progressFrom(ctx), &resource.size)
 
-		if realMimeType != "" {
-			mimeType = realMimeType
+	// a failed upload is retried by reading the entry again
+	body := &reopenableReader{Reader: limited, reopen: func() error {
+		readerCloser.Close()
+		entry, err := file.Open()
+		if err != nil {
+			return err
 		}
-	} else if mimeType == "" {
-		// fall back to the extension detected from content, eg. someone uploaded a .png with wrong extension
-		mimeType = contentMimeType
-	}
-
-	if mimeType == "" {
-		// default mime type
-		mimeType = "application/octet-stream"
-	}
-	resource.contentType = mimeType
-
-	resource.applyRewriteRules()
-
-	log.Printf("Sending: %s", resource)
-
-	limited := limitedReader(reader, file.UncompressedSize64, &resource.size)
-
-	err = a.Storage.PutFileWithSetup(a.Bucket, resource.key, limited, resource.setupRequest)
+		readerCloser = entry
+		reader = entry
+		resource.size = 0
+		return nil
+	}}
+
+	start := time.Now()
+	uploadCtx, stop := withTimeout(ctx, "upload", limits.FileTimeout)
+	err = a.Storage.PutFileWithSetup(uploadCtx, a.Bucket, resource.key, body, resource.setupRequest)
+	stop()
 	if err != nil {
-		return resource, errors.Wrap(err, 0)
+		return resource, errors.Wrap(timedOut(ctx, uploadCtx, err), 0)
 	}
+	observeDuration(metrics.fileUploadSeconds, start)
+	metrics.uploadedBytes.WithLabelValues("extract").Add(float64(resource.size))
 
 	return resource, nil
 }
 
 // ExtractZip downloads the zip at `key` to a temporary file,
-// then extracts its contents and uploads each item to `prefix`
-func (a *Archiver) ExtractZip(key, prefix string, limits *ExtractLimits) ([]ExtractedFile, error) {
-	fname, err := a.fetchZip(key)
+// then extracts its contents and uploads each item to `prefix`.
+// If ctx is canceled, the extraction stops and uploaded files are removed.
+// Downloading the zip and uploading each file are subject to the timeouts
+// in limits.
+func (a *Archiver) ExtractZip(ctx context.Context, key, prefix string, limits *ExtractLimits) ([]ExtractedFile, error) {
+	downloadCtx, stop := withTimeout(ctx, "download", limits.DownloadTimeout)
+	fname, err := a.fetchZip(downloadCtx, key)
+	stop()
 	if err != nil {
-		return nil, err
+		if ctx.Err() != nil {
+			return nil, abortedError(ctx)
+		}
+		return nil, errors.Wrap(timedOut(ctx, downloadCtx, err), 0)
 	}
 
 	defer os.Remove(fname)
 	prefix = path.Join(a.ExtractPrefix, prefix)
-	return a.sendZipExtracted(prefix, fname, limits)
+	return a.sendZipExtracted(ctx, prefix, fname, limits)
 }
 
-func (a *Archiver) UploadZipFromFile(fname string, prefix string, limits *ExtractLimits) ([]ExtractedFile, error) {
+func (a *Archiver) UploadZipFromFile(ctx context.Context, fname string, prefix string, limits *ExtractLimits) ([]ExtractedFile, error) {
 	prefix = path.Join("_zipserver", prefix)
-	return a.sendZipExtracted(prefix, fname, limits)
+	return a.sendZipExtracted(ctx, prefix, fname, limits)
 }
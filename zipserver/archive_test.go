@@ -3,12 +3,13 @@ package zipserver
 import (
 	"archive/zip"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
-	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -38,10 +39,10 @@ func Test_ExtractOnGCS(t *testing.T) {
 		assert.NoError(t, err)
 		defer r.Close()
 
-		err = storage.PutFile(config.Bucket, "zipserver_test/test.zip", r, "application/zip")
+		err = storage.PutFile(context.Background(), config.Bucket, "zipserver_test/test.zip", r, "application/zip")
 		assert.NoError(t, err)
 
-		_, err = archiver.ExtractZip("zipserver_test/test.zip", "zipserver_test/extract", testLimits())
+		_, err = archiver.ExtractZip(context.Background(), "zipserver_test/test.zip", "zipserver_test/extract", testLimits())
 		assert.NoError(t, err)
 	})
 }
@@ -81,7 +82,7 @@ func (zl *zipLayout) Check(t *testing.T, storage *MemStorage, bucket, prefix str
 			}
 
 			path := fmt.Sprintf("%s/%s", prefix, name)
-			reader, err := storage.GetFile(bucket, path)
+			reader, err := storage.GetFile(context.Background(), bucket, path)
 			if entry.ignored {
 				assert.Error(t, err)
 				assert.True(t, strings.Contains(err.Error(), "object not found"))
@@ -118,7 +119,7 @@ func Test_ExtractInMemory(t *testing.T) {
 	prefix := "zipserver_test/mem_test_extracted"
 	zipPath := "mem_test.zip"
 
-	_, err = archiver.ExtractZip(zipPath, prefix, testLimits())
+	_, err = archiver.ExtractZip(context.Background(), zipPath, prefix, testLimits())
 	assert.Error(t, err)
 
 	withZip := func(zl *zipLayout, cb func(zl *zipLayout)) {
@@ -131,7 +132,7 @@ func Test_ExtractInMemory(t *testing.T) {
 		err = zw.Close()
 		assert.NoError(t, err)
 
-		err = storage.PutFile(config.Bucket, zipPath, bytes.NewReader(buf.Bytes()), "application/octet-stream")
+		err = storage.PutFile(context.Background(), config.Bucket, zipPath, bytes.NewReader(buf.Bytes()), "application/octet-stream")
 		assert.NoError(t, err)
 
 		cb(zl)
@@ -210,7 +211,7 @@ func Test_ExtractInMemory(t *testing.T) {
 			},
 		},
 	}, func(zl *zipLayout) {
-		_, err := archiver.ExtractZip(zipPath, prefix, testLimits())
+		_, err := archiver.ExtractZip(context.Background(), zipPath, prefix, testLimits())
 		assert.NoError(t, err)
 
 		zl.Check(t, storage, config.Bucket, prefix)
@@ -228,7 +229,7 @@ func Test_ExtractInMemory(t *testing.T) {
 		limits := testLimits()
 		limits.MaxFileNameLength = 100
 
-		_, err := archiver.ExtractZip(zipPath, prefix, limits)
+		_, err := archiver.ExtractZip(context.Background(), zipPath, prefix, limits)
 		assert.Error(t, err)
 		assert.True(t, strings.Contains(err.Error(), "paths that are too long"))
 	})
@@ -245,7 +246,7 @@ func Test_ExtractInMemory(t *testing.T) {
 		limits := testLimits()
 		limits.MaxFileSize = 499
 
-		_, err := archiver.ExtractZip(zipPath, prefix, limits)
+		_, err := archiver.ExtractZip(context.Background(), zipPath, prefix, limits)
 		assert.Error(t, err)
 		assert.True(t, strings.Contains(err.Error(), "file that is too large"))
 	})
@@ -277,7 +278,7 @@ func Test_ExtractInMemory(t *testing.T) {
 		limits := testLimits()
 		limits.MaxNumFiles = 3
 
-		_, err := archiver.ExtractZip(zipPath, prefix, limits)
+		_, err := archiver.ExtractZip(context.Background(), zipPath, prefix, limits)
 		assert.Error(t, err)
 		assert.True(t, strings.Contains(err.Error(), "Too many files"))
 	})
@@ -309,7 +310,7 @@ func Test_ExtractInMemory(t *testing.T) {
 		limits := testLimits()
 		limits.MaxTotalSize = 6
 
-		_, err := archiver.ExtractZip(zipPath, prefix, limits)
+		_, err := archiver.ExtractZip(context.Background(), zipPath, prefix, limits)
 		assert.Error(t, err)
 		assert.True(t, strings.Contains(err.Error(), "zip too large"))
 	})
@@ -318,7 +319,8 @@ func Test_ExtractInMemory(t *testing.T) {
 	storage, err = NewMemStorage()
 	assert.NoError(t, err)
 	storage.planForFailure(config.Bucket, fmt.Sprintf("%s/%s", prefix, "3"))
-	storage.putDelay = 200 * time.Millisecond
+	// the other uploads are still going when 3 fails
+	storage.stallPuts(prefix)
 	archiver = &Archiver{storage, config}
 
 	withZip(&zipLayout{
@@ -347,7 +349,7 @@ func Test_ExtractInMemory(t *testing.T) {
 	}, func(zl *zipLayout) {
 		limits := testLimits()
 
-		_, err := archiver.ExtractZip(zipPath, prefix, limits)
+		_, err := archiver.ExtractZip(context.Background(), zipPath, prefix, limits)
 		assert.Error(t, err)
 		assert.True(t, strings.Contains(err.Error(), "intentional failure"))
 
@@ -356,4 +358,147 @@ func Test_ExtractInMemory(t *testing.T) {
 			assert.EqualValues(t, k, storage.objectPath(config.Bucket, zipPath), "make sure the only remaining object is the zip")
 		}
 	})
+
+	withZip(&zipLayout{
+		entries: []zipEntry{
+			zipEntry{
+				name:             "1",
+				data:             []byte("uh oh"),
+				expectedMimeType: "text/plain; charset=utf-8",
+			},
+			zipEntry{
+				name:             "2",
+				data:             []byte("uh oh"),
+				expectedMimeType: "text/plain; charset=utf-8",
+			},
+		},
+	}, func(zl *zipLayout) {
+		limits := testLimits()
+		limits.ExtractionThreads = 1
+
+		fname, err := archiver.fetchZip(context.Background(), zipPath)
+		assert.NoError(t, err)
+		defer os.Remove(fname)
+
+		// first upload goes through, then we're aborted
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		puts := 0
+		storage.onPut(func(ctx context.Context, key string) error {
+			puts++
+			if puts == 1 {
+				return nil
+			}
+
+			cancel()
+			<-ctx.Done()
+			return ctx.Err()
+		})
+
+		_, err = archiver.sendZipExtracted(ctx, prefix, fname, limits)
+		assert.Error(t, err)
+		assert.True(t, strings.Contains(err.Error(), "Extraction aborted"))
+
+		assert.EqualValues(t, 1, len(storage.objects), "make sure all objects have been cleaned up")
+	})
+}
+
+func Test_AbortInterruptsUploads(t *testing.T) {
+	config := emptyConfig()
+
+	storage, err := NewMemStorage()
+	assert.NoError(t, err)
+	// uploads would take forever if they weren't interrupted
+	started := make(chan struct{})
+	storage.onPut(func(ctx context.Context, key string) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	archiver := &Archiver{storage, config}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	zl := &zipLayout{
+		entries: []zipEntry{
+			zipEntry{name: "1", data: []byte("uh oh")},
+		},
+	}
+	zl.Write(t, zw)
+	assert.NoError(t, zw.Close())
+
+	fname := filepath.Join(t.TempDir(), "interrupt.zip")
+	assert.NoError(t, os.WriteFile(fname, buf.Bytes(), 0644))
+
+	ctx, abort := withAbort(context.Background())
+	go func() {
+		<-started
+		abort(errCanceled)
+	}()
+
+	_, err = archiver.sendZipExtracted(ctx, "zipserver_test/interrupt", fname, testLimits())
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "Extraction aborted: canceled by request"))
+	assert.EqualValues(t, 0, len(storage.objects))
+}
+
+func Test_FetchZipConcurrently(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+	storage, err := NewMemStorage()
+	assert.NoError(t, err)
+	archiver := &Archiver{storage, config}
+
+	assert.NoError(t, storage.PutFile(ctx, config.Bucket, "zips/game.zip", strings.NewReader("not really a zip"), "application/zip"))
+
+	// extractions of the same zip to different prefixes don't share a file
+	first, err := archiver.fetchZip(ctx, "zips/game.zip")
+	assert.NoError(t, err)
+	second, err := archiver.fetchZip(ctx, "zips/game.zip")
+	assert.NoError(t, err)
+	assert.NotEqual(t, first, second)
+
+	assert.NoError(t, os.Remove(first))
+	data, err := os.ReadFile(second)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "not really a zip", string(data))
+	os.Remove(second)
+}
+
+func Test_ExtractRetriesReopenEntries(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+	memStorage, err := NewMemStorage()
+	assert.NoError(t, err)
+
+	data := bytes.Repeat([]byte("retried "), 1024)
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	writer, err := zw.Create("file.txt")
+	assert.NoError(t, err)
+	_, err = writer.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+	assert.NoError(t, memStorage.PutFile(ctx, config.Bucket, "retry.zip", bytes.NewReader(buf.Bytes()), "application/zip"))
+
+	// the first upload fails partway, and is sent again from a reopened entry
+	flaky := &flakyStorage{MemStorage: memStorage, failures: 1, err: newStorageError(503, "503 Service Unavailable", "https://example.org")}
+	archiver := &Archiver{newRetryingStorage(flaky, testRetryConfig()), config}
+
+	progress := &progressTracker{}
+	files, err := archiver.ExtractZip(withProgress(ctx, progress), "retry.zip", "retried", testLimits())
+	assert.NoError(t, err)
+	assert.EqualValues(t, []ExtractedFile{{Key: "retried/file.txt", Size: uint64(len(data))}}, files)
+	assert.EqualValues(t, 2, flaky.calls)
+
+	uploaded, _ := progress.snapshot()
+	assert.EqualValues(t, len(data), uploaded.BytesUploaded, "retried bytes shouldn't be counted twice")
+
+	reader, err := memStorage.GetFile(ctx, config.Bucket, "retried/file.txt")
+	assert.NoError(t, err)
+	stored, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.EqualValues(t, data, stored)
 }
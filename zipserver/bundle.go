@@ -0,0 +1,257 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"context"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	errors "github.com/go-errors/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var errUploadStopped = errors.New("Upload stopped")
+
+// BundledFile is an object added to a bundle
+type BundledFile struct {
+	// key of the object, and its name in the zip
+	Key  string
+	Name string
+	Size uint64
+	// store or deflate
+	Method string
+}
+
+// BundleResult describes a zip made by Bundle
+type BundleResult struct {
+	Key   string
+	Size  uint64
+	Files []BundledFile
+}
+
+// alreadyCompressed are content types deflate wouldn't make any smaller
+var alreadyCompressed = map[string]bool{
+	"application/zip":              true,
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/x-7z-compressed":  true,
+	"application/x-rar-compressed": true,
+	"application/x-bzip2":          true,
+	"application/x-xz":             true,
+	"font/woff":                    true,
+	"font/woff2":                   true,
+}
+
+// bundleMethod picks how a file is stored in a bundle, given what extracting
+// it would upload it as
+func bundleMethod(resource *ResourceSpec) uint16 {
+	if resource.contentEncoding != "" {
+		return zip.Store
+	}
+
+	contentType := strings.TrimSpace(strings.Split(resource.contentType, ";")[0])
+	switch {
+	case alreadyCompressed[contentType]:
+		return zip.Store
+	case strings.HasPrefix(contentType, "video/"), strings.HasPrefix(contentType, "audio/"):
+		return zip.Store
+	case strings.HasPrefix(contentType, "image/"):
+		// only uncompressed formats are worth deflating
+		if contentType == "image/svg+xml" || contentType == "image/bmp" || contentType == "image/x-icon" {
+			return zip.Deflate
+		}
+		return zip.Store
+	}
+	return zip.Deflate
+}
+
+// validBundleName returns false for names of files to bundle that could
+// escape the prefix, or that would make unsafe zip entries
+func validBundleName(name string) bool {
+	if name == "" || path.IsAbs(name) || path.Clean(name) != name {
+		return false
+	}
+
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// bundleSources returns the objects to bundle: every object under prefix, or
+// the given keys relative to it. Listed objects are checked against limits
+// right away, the others as they're read.
+func (a *Archiver) bundleSources(ctx context.Context, prefix string, keys []string, destKey string, limits *ExtractLimits) ([]BundledFile, error) {
+	files := []BundledFile{}
+
+	if len(keys) > 0 {
+		for _, key := range keys {
+			if !validBundleName(key) {
+				return nil, badRequest("Invalid file name: %q", key)
+			}
+			files = append(files, BundledFile{Key: path.Join(prefix, key), Name: key})
+		}
+	} else {
+		// games/1 is a directory, it doesn't contain games/10
+		dirPrefix := prefix
+		if prefix != "" {
+			dirPrefix = strings.TrimSuffix(prefix, "/") + "/"
+		}
+		objects, err := a.Storage.ListFiles(ctx, a.Bucket, dirPrefix)
+		if err != nil {
+			return nil, err
+		}
+
+		var byteCount uint64
+		for _, object := range objects {
+			if strings.HasSuffix(object.Key, "/") || object.Key == destKey {
+				continue
+			}
+
+			name := strings.TrimPrefix(object.Key, dirPrefix)
+			if !validBundleName(name) {
+				return nil, badRequest("Invalid file name: %q", name)
+			}
+
+			if object.Size > limits.MaxFileSize {
+				return nil, limitExceeded("Bundle contains file that is too large (%s)", name)
+			}
+
+			byteCount += object.Size
+			if byteCount > limits.MaxTotalSize {
+				return nil, limitExceeded("Bundle too large (max %v bytes)", limits.MaxTotalSize)
+			}
+
+			files = append(files, BundledFile{Key: object.Key, Name: name, Size: object.Size})
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, badRequest("Nothing to bundle in %s", prefix)
+	}
+
+	if len(files) > limits.MaxNumFiles {
+		return nil, limitExceeded("Too many files in bundle (%v > %v)", len(files), limits.MaxNumFiles)
+	}
+
+	return files, nil
+}
+
+// writeBundle streams files from storage into zw, filling in their sizes and
+// methods. What's read is counted as downloaded for operation.
+func (a *Archiver) writeBundle(ctx context.Context, zw *zip.Writer, files []BundledFile, limits *ExtractLimits, operation string) error {
+	var totalBytes uint64
+
+	for i := range files {
+		file := &files[i]
+
+		err := func() error {
+			reader, err := a.Storage.GetFile(ctx, a.Bucket, file.Key)
+			if err != nil {
+				return err
+			}
+			defer reader.Close()
+
+			var fileBytes uint64
+			limited := limitedReader(contextReader(ctx, reader), limits.MaxFileSize, &fileBytes)
+
+			head := make([]byte, sniffLen)
+			n, err := io.ReadFull(limited, head)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			head = head[:n]
+
+			method := bundleMethod(newResourceSpec(file.Name, head))
+			writer, err := zw.CreateHeader(&zip.FileHeader{
+				Name:     file.Name,
+				Method:   method,
+				Modified: time.Now(),
+			})
+			if err != nil {
+				return err
+			}
+
+			_, err = writer.Write(head)
+			if err != nil {
+				return err
+			}
+
+			_, err = io.Copy(writer, limited)
+			if err != nil {
+				return err
+			}
+
+			file.Size = fileBytes
+			file.Method = methodName(method)
+			return nil
+		}()
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+
+		totalBytes += file.Size
+		if totalBytes > limits.MaxTotalSize {
+			return errors.Wrap(limitExceeded("Bundle too large (max %v bytes)", limits.MaxTotalSize), 0)
+		}
+		metrics.downloadedBytes.WithLabelValues(operation).Add(float64(file.Size))
+	}
+
+	return zw.Close()
+}
+
+// Bundle zips objects of the bucket into a new object at destKey: everything
+// under prefix, or only the given keys, relative to prefix. The zip is
+// streamed to storage as it's made, so nothing is stored if anything fails.
+func (a *Archiver) Bundle(ctx context.Context, destKey, prefix string, keys []string, limits *ExtractLimits) (_ *BundleResult, err error) {
+	ctx, span := startSpan(ctx, "Archiver.Bundle",
+		attribute.String("bundle.key", destKey), attribute.String("bundle.prefix", prefix))
+	defer func() { endSpan(span, err) }()
+
+	files, err := a.bundleSources(ctx, prefix, keys, destKey, limits)
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	loggerFrom(ctx).Infof("Bundling %d files from %s into %s", len(files), prefix, destKey)
+
+	// the upload reads what writing the zip produces
+	pipeReader, pipeWriter := io.Pipe()
+	writeErr := make(chan error, 1)
+	go func() {
+		err := a.writeBundle(ctx, zip.NewWriter(pipeWriter), files, limits, "bundle")
+		pipeWriter.CloseWithError(err)
+		writeErr <- err
+	}()
+
+	acl := a.BundleACL
+	if acl == "" {
+		acl = "private"
+	}
+
+	var zipSize uint64
+	err = a.Storage.PutFileWithSetup(ctx, a.Bucket, destKey, countingReader(pipeReader, &zipSize), func(req *http.Request) error {
+		req.Header.Add("Content-Type", "application/zip")
+		req.Header.Add("x-goog-acl", acl)
+		return nil
+	})
+	// stops writing the zip if the upload failed
+	pipeReader.CloseWithError(errUploadStopped)
+
+	// when both fail, one caused the other
+	bundleErr := <-writeErr
+	if bundleErr != nil && !errors.Is(bundleErr, errUploadStopped) {
+		return nil, bundleErr
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	metrics.uploadedBytes.WithLabelValues("bundle").Add(float64(zipSize))
+	return &BundleResult{Key: destKey, Size: zipSize, Files: files}, nil
+}
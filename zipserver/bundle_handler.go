@@ -0,0 +1,47 @@
+package zipserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+func bundleHandler(w http.ResponseWriter, r *http.Request) error {
+	req, err := parseBundleRequest(r)
+	if err != nil {
+		return err
+	}
+
+	limits := req.Limits.limits(config)
+
+	process := func(ctx context.Context) (interface{}, error) {
+		defer trackInFlight("bundle")()
+
+		ctx, stop := withTimeout(ctx, "bundle", limits.JobTimeout)
+		defer stop()
+
+		archiver := NewArchiver(config)
+		result, err := archiver.Bundle(ctx, req.Key, req.Prefix, req.Files, limits)
+		if err != nil && ctx.Err() != nil {
+			err = fmt.Errorf("Bundle aborted: %w", abortReason(ctx))
+		}
+		metrics.operations.WithLabelValues("bundle", outcomeLabel(err)).Inc()
+		if err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+
+	return runJob(w, r, req.Callback.URL, "BundleError", process,
+		func(values url.Values, result interface{}) {
+			bundled := result.(*BundleResult)
+			values.Add("Key", bundled.Key)
+			values.Add("Size", strconv.FormatUint(bundled.Size, 10))
+			for i, file := range bundled.Files {
+				values.Add(fmt.Sprintf("Files[%d][Name]", i+1), file.Name)
+				values.Add(fmt.Sprintf("Files[%d][Size]", i+1), strconv.FormatUint(file.Size, 10))
+			}
+		})
+}
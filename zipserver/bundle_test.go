@@ -0,0 +1,101 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Bundle(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+	storage, err := NewMemStorage()
+	assert.NoError(t, err)
+	archiver := &Archiver{storage, config}
+
+	put := func(key string, data []byte) {
+		assert.NoError(t, storage.PutFile(ctx, config.Bucket, key, bytes.NewReader(data), "application/octet-stream"))
+	}
+
+	html := []byte("<!doctype html><html>" + strings.Repeat("hello ", 100) + "</html>")
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{1, 2, 3}, 100)...)
+	put("games/1/index.html", html)
+	put("games/1/img/logo.png", png)
+	put("games/10/other.txt", []byte("not this one"))
+
+	result, err := archiver.Bundle(ctx, "bundles/1.zip", "games/1/", nil, testLimits())
+	assert.NoError(t, err)
+	assert.EqualValues(t, "bundles/1.zip", result.Key)
+	assert.EqualValues(t, []BundledFile{
+		{Key: "games/1/img/logo.png", Name: "img/logo.png", Size: uint64(len(png)), Method: "store"},
+		{Key: "games/1/index.html", Name: "index.html", Size: uint64(len(html)), Method: "deflate"},
+	}, result.Files)
+
+	// bundles aren't public unless configured to be
+	headers, err := storage.getHeaders(config.Bucket, "bundles/1.zip")
+	assert.NoError(t, err)
+	assert.EqualValues(t, "private", headers.Get("x-goog-acl"))
+	assert.EqualValues(t, "application/zip", headers.Get("Content-Type"))
+
+	reader, err := storage.GetFile(ctx, config.Bucket, "bundles/1.zip")
+	assert.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.EqualValues(t, result.Size, len(data))
+
+	zipReader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	assert.NoError(t, err)
+	if assert.EqualValues(t, 2, len(zipReader.File)) {
+		entry, err := zipReader.File[1].Open()
+		assert.NoError(t, err)
+		contents, err := io.ReadAll(entry)
+		assert.NoError(t, err)
+		assert.EqualValues(t, html, contents)
+	}
+
+	// without a trailing slash, games/10 is still left out
+	config.BundleACL = "public-read"
+	result, err = archiver.Bundle(ctx, "bundles/1-noslash.zip", "games/1", nil, testLimits())
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, len(result.Files))
+	assert.EqualValues(t, "img/logo.png", result.Files[0].Name)
+	headers, err = storage.getHeaders(config.Bucket, "bundles/1-noslash.zip")
+	assert.NoError(t, err)
+	assert.EqualValues(t, "public-read", headers.Get("x-goog-acl"))
+	config.BundleACL = ""
+
+	// names can't escape the prefix
+	for _, name := range []string{"../10/other.txt", "img/../../10/other.txt", "/games/10/other.txt", "./index.html", ""} {
+		_, err = archiver.Bundle(ctx, "bundles/escape.zip", "games/1", []string{name}, testLimits())
+		assert.EqualValues(t, http.StatusBadRequest, statusCodeFor(err), name)
+	}
+
+	// only some keys
+	result, err = archiver.Bundle(ctx, "bundles/1-index.zip", "games/1", []string{"index.html"}, testLimits())
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, len(result.Files))
+	assert.EqualValues(t, "index.html", result.Files[0].Name)
+
+	// limits
+	limits := testLimits()
+	limits.MaxFileSize = 100
+	_, err = archiver.Bundle(ctx, "bundles/too-big.zip", "games/1/", nil, limits)
+	assert.EqualValues(t, http.StatusUnprocessableEntity, statusCodeFor(err))
+
+	_, err = archiver.Bundle(ctx, "bundles/too-big.zip", "games/1", []string{"index.html"}, limits)
+	assert.EqualValues(t, http.StatusUnprocessableEntity, statusCodeFor(err), "checked while reading too")
+	_, err = storage.GetFile(ctx, config.Bucket, "bundles/too-big.zip")
+	assert.Error(t, err, "nothing is stored when bundling fails")
+
+	_, err = archiver.Bundle(ctx, "bundles/missing.zip", "games/1", []string{"nope.html"}, testLimits())
+	assert.EqualValues(t, http.StatusNotFound, statusCodeFor(err))
+
+	_, err = archiver.Bundle(ctx, "bundles/empty.zip", "games/2/", nil, testLimits())
+	assert.EqualValues(t, http.StatusBadRequest, statusCodeFor(err))
+}
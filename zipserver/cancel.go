@@ -0,0 +1,147 @@
+package zipserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+var (
+	errCanceled     = errors.New("canceled by request")
+	errClientGone   = errors.New("client disconnected")
+	errNoRunningJob = errors.New("no running job with that ID")
+)
+
+// aborter remembers why a context was canceled
+type aborter struct {
+	sync.Mutex
+	reason error
+	parent context.Context
+}
+
+// withAbort returns a copy of ctx along with a function canceling it for a
+// given reason, which abortReason reports. Only the first reason sticks.
+func withAbort(ctx context.Context) (context.Context, func(reason error)) {
+	a := &aborter{parent: ctx}
+	ctx, cancel := context.WithCancel(ctx)
+	ctx = context.WithValue(ctx, abortKey, a)
+
+	return ctx, func(reason error) {
+		a.Lock()
+		if a.reason == nil {
+			a.reason = reason
+		}
+		a.Unlock()
+		cancel()
+	}
+}
+
+// abortReason returns why ctx was canceled, nil if it wasn't
+func abortReason(ctx context.Context) error {
+	if ctx.Err() == nil {
+		return nil
+	}
+
+	a, ok := ctx.Value(abortKey).(*aborter)
+	if !ok {
+		return ctx.Err()
+	}
+
+	a.Lock()
+	reason := a.reason
+	a.Unlock()
+
+	if reason != nil {
+		return reason
+	}
+	if a.parent.Err() != nil {
+		// canceled from further up
+		return abortReason(a.parent)
+	}
+	return ctx.Err()
+}
+
+// abortOnDisconnect aborts work when the client of r goes away, until the
+// returned function is called
+func abortOnDisconnect(r *http.Request, abort func(reason error)) func() {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-r.Context().Done():
+			abort(errClientGone)
+		case <-stop:
+		}
+	}()
+
+	return func() { close(stop) }
+}
+
+// cancelable is a job that can be canceled through /cancel
+type cancelable struct {
+	cancel func(reason error)
+}
+
+var cancelables struct {
+	sync.Mutex
+	byJobID map[string]*cancelable
+}
+
+func init() {
+	cancelables.byJobID = make(map[string]*cancelable)
+}
+
+// registerCancelable makes a running job cancelable by ID, until the
+// returned function is called. Job IDs are generated by newID, so they're
+// unique.
+func registerCancelable(jobID string, cancel func(reason error)) func() {
+	cancelables.Lock()
+	defer cancelables.Unlock()
+
+	c := &cancelable{cancel}
+	cancelables.byJobID[jobID] = c
+
+	return func() {
+		cancelables.Lock()
+		defer cancelables.Unlock()
+
+		if cancelables.byJobID[jobID] == c {
+			delete(cancelables.byJobID, jobID)
+		}
+	}
+}
+
+// cancelJob cancels the running job with the given ID, returns false if
+// there's no such job
+func cancelJob(jobID string) bool {
+	cancelables.Lock()
+	c, ok := cancelables.byJobID[jobID]
+	cancelables.Unlock()
+
+	if ok {
+		c.cancel(errCanceled)
+	}
+	return ok
+}
+
+func cancelHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requirePost(w, r); err != nil {
+		return writeJSONError(w, "CancelError", err)
+	}
+
+	params := r.URL.Query()
+	jobID, err := getParam(params, "job")
+	if err != nil {
+		return err
+	}
+
+	if !cancelJob(jobID) {
+		return writeJSONError(w, "CancelError", fmt.Errorf("%w: %s", errNoRunningJob, jobID))
+	}
+
+	loggerFrom(r.Context()).Infof("Canceled job %s", jobID)
+	return writeJSONMessage(w, struct {
+		Success bool
+	}{true})
+}
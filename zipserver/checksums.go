@@ -0,0 +1,128 @@
+package zipserver
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+)
+
+var errChecksumMismatch = errors.New("Checksum mismatch")
+
+// Digests are the hashes of a slurped file, hex encoded
+type Digests struct {
+	SHA256 string `json:",omitempty"`
+	MD5    string `json:",omitempty"`
+	CRC32C string `json:",omitempty"`
+}
+
+// normalizeDigest turns a digest of size bytes given in hex, or in base64
+// like GCS reports them, into hex
+func normalizeDigest(name, value string, size int) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	if decoded, err := hex.DecodeString(value); err == nil && len(decoded) == size {
+		return strings.ToLower(value), nil
+	}
+
+	if decoded, err := base64.StdEncoding.DecodeString(value); err == nil && len(decoded) == size {
+		return hex.EncodeToString(decoded), nil
+	}
+
+	return "", badRequest("Invalid %s: expected %d bytes in hex or base64", name, size)
+}
+
+// normalize checks the digests are well-formed, and hex encodes them
+func (d *Digests) normalize() error {
+	var err error
+
+	d.SHA256, err = normalizeDigest("sha256", d.SHA256, sha256.Size)
+	if err != nil {
+		return err
+	}
+
+	d.MD5, err = normalizeDigest("md5", d.MD5, md5.Size)
+	if err != nil {
+		return err
+	}
+
+	d.CRC32C, err = normalizeDigest("crc32c", d.CRC32C, crc32.Size)
+	return err
+}
+
+// verify fails if any of the expected digests d has differs from computed
+func (d Digests) verify(computed Digests) error {
+	checks := []struct{ name, expected, computed string }{
+		{"sha256", d.SHA256, computed.SHA256},
+		{"md5", d.MD5, computed.MD5},
+		{"crc32c", d.CRC32C, computed.CRC32C},
+	}
+
+	for _, check := range checks {
+		if check.expected != "" && check.expected != check.computed {
+			return fmt.Errorf("%w: %s is %s, expected %s",
+				errChecksumMismatch, check.name, check.computed, check.expected)
+		}
+	}
+	return nil
+}
+
+// digestReader hashes what's read through it
+type digestReader struct {
+	source io.Reader
+	sha256 hash.Hash
+	md5    hash.Hash
+	crc32c hash.Hash32
+}
+
+func newDigestReader(source io.Reader) *digestReader {
+	return &digestReader{
+		source: source,
+		sha256: sha256.New(),
+		md5:    md5.New(),
+		crc32c: crc32.New(crc32.MakeTable(crc32.Castagnoli)),
+	}
+}
+
+func (dr *digestReader) Read(p []byte) (int, error) {
+	n, err := dr.source.Read(p)
+	dr.sha256.Write(p[:n])
+	dr.md5.Write(p[:n])
+	dr.crc32c.Write(p[:n])
+	return n, err
+}
+
+// digests returns the hashes of what was read
+func (dr *digestReader) digests() Digests {
+	return Digests{
+		SHA256: hex.EncodeToString(dr.sha256.Sum(nil)),
+		MD5:    hex.EncodeToString(dr.md5.Sum(nil)),
+		CRC32C: hex.EncodeToString(dr.crc32c.Sum(nil)),
+	}
+}
+
+// fileDigests hashes the file at fname
+func fileDigests(ctx context.Context, fname string) (Digests, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return Digests{}, err
+	}
+	defer file.Close()
+
+	dr := newDigestReader(contextReader(ctx, file))
+	_, err = io.Copy(io.Discard, dr)
+	if err != nil {
+		return Digests{}, err
+	}
+	return dr.digests(), nil
+}
@@ -0,0 +1,50 @@
+package zipserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Digests(t *testing.T) {
+	ctx := context.Background()
+	helloWorld := Digests{
+		SHA256: "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
+		MD5:    "5eb63bbbe01eeed093cb22bb8f5acdc3",
+		CRC32C: "c99465aa",
+	}
+
+	fname := filepath.Join(t.TempDir(), "hello.txt")
+	assert.NoError(t, os.WriteFile(fname, []byte("hello world"), 0644))
+	digests, err := fileDigests(ctx, fname)
+	assert.NoError(t, err)
+	assert.EqualValues(t, helloWorld, digests)
+
+	// expected digests
+	expected := Digests{MD5: "XrY7u+Ae7tCTyyK7j1rNww==", CRC32C: "C99465AA"}
+	assert.NoError(t, expected.normalize())
+	assert.EqualValues(t, Digests{MD5: helloWorld.MD5, CRC32C: "c99465aa"}, expected)
+	assert.NoError(t, expected.verify(helloWorld))
+
+	expected.SHA256 = strings.Repeat("00", 32)
+	err = expected.verify(helloWorld)
+	assert.EqualValues(t, http.StatusUnprocessableEntity, statusCodeFor(err))
+	assert.Contains(t, err.Error(), "sha256 is b94d27b9")
+
+	expected = Digests{MD5: "5eb63bbbe01eeed0"}
+	err = expected.normalize()
+	assert.EqualError(t, err, "Invalid md5: expected 16 bytes in hex or base64")
+
+	_, err = parseSlurpRequest(httptest.NewRequest("GET", "/slurp?key=a&url=b&crc32c=nope", nil))
+	assert.EqualValues(t, http.StatusBadRequest, statusCodeFor(err))
+
+	slurpReq, err := parseSlurpRequest(httptest.NewRequest("GET", "/slurp?key=a&url=b&sha256="+helloWorld.SHA256, nil))
+	assert.NoError(t, err)
+	assert.EqualValues(t, helloWorld.SHA256, slurpReq.Checksums.SHA256)
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"time"
 
 	errors "github.com/go-errors/errors"
 )
@@ -19,6 +20,15 @@ type ExtractLimits struct {
 	MaxNumFiles       int
 	MaxFileNameLength int
 	ExtractionThreads int
+
+	// only extract these files of the zip, all of them if empty
+	OnlyFiles []string
+
+	// how long the whole extraction, downloading the zip and uploading
+	// each file may take. 0 means no limit
+	JobTimeout      time.Duration
+	DownloadTimeout time.Duration
+	FileTimeout     time.Duration
 }
 
 // Config contains both storage configuration and the enforced extraction limits
@@ -33,6 +43,74 @@ type Config struct {
 	MaxNumFiles       int
 	MaxFileNameLength int
 	ExtractionThreads int
+
+	// Seconds an extraction or a slurp may take as a whole, downloading a
+	// zip or a slurped URL may take, and uploading a single extracted file
+	// may take, retries included. 0 means no limit
+	JobTimeout        int
+	DownloadTimeout   int
+	FileUploadTimeout int
+
+	// Seconds to wait for in-flight extractions and slurps on shutdown
+	// before aborting them
+	ShutdownTimeout int
+
+	// Maximum attempts for each kind of storage call, retrying transient
+	// errors. 1 disables retries
+	StorageGetAttempts    int
+	StoragePutAttempts    int
+	StorageDeleteAttempts int
+	// Delay before retrying a storage call in milliseconds, doubled on every
+	// attempt up to StorageRetryMaxDelayMs
+	StorageRetryBaseDelayMs int
+	StorageRetryMaxDelayMs  int
+
+	// Slurped URLs are downloaded to the temporary directory first. When
+	// the connection drops, the download resumes where it stopped, up to
+	// SlurpAttempts times in a row without getting anything. Servers
+	// supporting range requests are downloaded from over SlurpConnections
+	// connections at once, SlurpChunkSize bytes at a time
+	SlurpAttempts    int
+	SlurpConnections int
+	SlurpChunkSize   uint64
+
+	// /readyz fails when the temporary directory has less free space than
+	// this, in bytes
+	MinTmpFreeSpace uint64
+	// /readyz fails when this many extractions and slurps are in flight,
+	// 0 means no limit
+	MaxInFlightJobs int
+
+	// One of debug, info, warn, error. Defaults to info
+	LogLevel string
+	// Either text or json. Defaults to text
+	LogFormat string
+
+	// URL of an OTLP/HTTP collector to export traces to, eg.
+	// http://localhost:4318. Tracing is disabled if empty
+	OTLPEndpoint string
+
+	// /slurp/extract refuses zips larger than this, in bytes. Callers may
+	// only ask for a lower limit. 0 means no limit
+	MaxInputZipSize uint64
+
+	// /list reads zips with range requests. When listing a URL that
+	// doesn't support them, it's downloaded as long as it's no larger than
+	// this, in bytes
+	MaxListFallbackSize uint64
+
+	// /serve keeps the central directories of this many zips, for
+	// ServeCacheTTL seconds. 0 disables the cache
+	ServeCacheSize int
+	ServeCacheTTL  int
+
+	// File where objects that aborted extractions failed to delete are
+	// recorded, so they can be swept later. Not recorded if empty
+	OrphanLogPath string
+
+	// Canned ACL bundles are stored with, eg. public-read. Defaults to
+	// private
+	BundleACL string
 }
 
 var defaultConfig = Config{
@@ -41,6 +119,33 @@ var defaultConfig = Config{
 	MaxNumFiles:       100,
 	MaxFileNameLength: 80,
 	ExtractionThreads: 4,
+	JobTimeout:        60 * 30,
+	DownloadTimeout:   60 * 10,
+	FileUploadTimeout: 60 * 5,
+	ShutdownTimeout:   60,
+
+	StorageGetAttempts:      3,
+	StoragePutAttempts:      3,
+	StorageDeleteAttempts:   5,
+	StorageRetryBaseDelayMs: 200,
+	StorageRetryMaxDelayMs:  5000,
+
+	SlurpAttempts:    5,
+	SlurpConnections: 1,
+	SlurpChunkSize:   1024 * 1024 * 16,
+
+	MinTmpFreeSpace: 1024 * 1024 * 1024,
+
+	MaxInputZipSize: 1024 * 1024 * 1024,
+
+	MaxListFallbackSize: 1024 * 1024 * 100,
+
+	ServeCacheSize: 100,
+	ServeCacheTTL:  60,
+
+	BundleACL: "private",
+
+	OrphanLogPath: "zipserver_orphans.jsonl",
 }
 
 // LoadConfig reads a config file into a config struct
@@ -93,5 +198,8 @@ func DefaultExtractLimits(config *Config) *ExtractLimits {
 		MaxNumFiles:       config.MaxNumFiles,
 		MaxFileNameLength: config.MaxFileNameLength,
 		ExtractionThreads: config.ExtractionThreads,
+		JobTimeout:        seconds(config.JobTimeout),
+		DownloadTimeout:   seconds(config.DownloadTimeout),
+		FileTimeout:       seconds(config.FileUploadTimeout),
 	}
 }
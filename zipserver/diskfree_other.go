@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package zipserver
+
+// diskFree returns the number of bytes available to us on the filesystem
+// containing dir
+func diskFree(dir string) (uint64, error) {
+	return 0, errDiskFreeUnsupported
+}
@@ -0,0 +1,74 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+)
+
+// downloadBundle streams a zip of objects of the bucket to w as it's made,
+// zip64 kicking in for large ones. Returns whether the response was started,
+// after which errors can't be reported to the client.
+func downloadBundle(ctx context.Context, archiver *Archiver, req *DownloadRequest, limits *ExtractLimits, w http.ResponseWriter) (bool, error) {
+	files, err := archiver.bundleSources(ctx, req.Prefix, req.Files, "", limits)
+	if err != nil {
+		return false, err
+	}
+
+	loggerFrom(ctx).Infof("Streaming %d files from %s as %s", len(files), req.Prefix, req.Filename)
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": req.Filename,
+	}))
+	w.WriteHeader(http.StatusOK)
+
+	return true, archiver.writeBundle(ctx, zip.NewWriter(w), files, limits, "download")
+}
+
+func downloadHandler(w http.ResponseWriter, r *http.Request) error {
+	req, err := parseDownloadRequest(r)
+	if err != nil {
+		return err
+	}
+
+	limits := req.Limits.limits(config)
+
+	ctx, done, err := beginWork()
+	if err != nil {
+		return writeJSONError(w, "DownloadError", err)
+	}
+	defer done()
+	defer trackInFlight("download")()
+
+	// the client learns the ID from the headers, in case it wants to cancel
+	jobID := newID()
+	ctx = jobContext(ctx, r, jobID)
+	w.Header().Set("X-Job-Id", jobID)
+
+	ctx, abort := withAbort(ctx)
+	defer abort(nil)
+	defer registerCancelable(jobID, abort)()
+	defer abortOnDisconnect(r, abort)()
+
+	ctx, stop := withTimeout(ctx, "download", limits.JobTimeout)
+	defer stop()
+
+	started, err := downloadBundle(ctx, NewArchiver(config), req, limits, w)
+	if err != nil && ctx.Err() != nil {
+		err = fmt.Errorf("Download aborted: %w", abortReason(ctx))
+	}
+	metrics.operations.WithLabelValues("download", outcomeLabel(err)).Inc()
+
+	if err != nil {
+		loggerFrom(ctx).Errorf("Download of %s failed: %s", req.Prefix, err.Error())
+		if started {
+			// the client gets a zip cut short
+			return nil
+		}
+		return writeJSONError(w, "DownloadError", err)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_DownloadBundle(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+	storage, err := NewMemStorage()
+	assert.NoError(t, err)
+	archiver := &Archiver{storage, config}
+
+	for key, data := range map[string]string{
+		"games/1/index.html":    "<html></html>",
+		"games/1/js/game.js":    "console.log('hi')",
+		"games/2/unrelated.txt": "nope",
+	} {
+		assert.NoError(t, storage.PutFile(ctx, config.Bucket, key, bytes.NewReader([]byte(data)), "application/octet-stream"))
+	}
+
+	req, err := parseDownloadRequest(httptest.NewRequest("GET", "/download?prefix=games/1/", nil))
+	assert.NoError(t, err)
+	assert.EqualValues(t, "1.zip", req.Filename)
+
+	rec := httptest.NewRecorder()
+	started, err := downloadBundle(ctx, archiver, req, testLimits(), rec)
+	assert.NoError(t, err)
+	assert.True(t, started)
+	assert.EqualValues(t, "application/zip", rec.Header().Get("Content-Type"))
+	assert.EqualValues(t, `attachment; filename=1.zip`, rec.Header().Get("Content-Disposition"))
+
+	body := rec.Body.Bytes()
+	zipReader, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if assert.NoError(t, err) && assert.EqualValues(t, 2, len(zipReader.File)) {
+		assert.EqualValues(t, "index.html", zipReader.File[0].Name)
+		assert.EqualValues(t, "js/game.js", zipReader.File[1].Name)
+
+		reader, err := zipReader.File[1].Open()
+		assert.NoError(t, err)
+		contents, err := io.ReadAll(reader)
+		assert.NoError(t, err)
+		assert.EqualValues(t, "console.log('hi')", string(contents))
+	}
+
+	limits := testLimits()
+	limits.MaxNumFiles = 1
+	rec = httptest.NewRecorder()
+	started, err = downloadBundle(ctx, archiver, req, limits, rec)
+	assert.False(t, started, "limits are checked before anything is sent")
+	assert.EqualValues(t, http.StatusUnprocessableEntity, statusCodeFor(err))
+}
@@ -0,0 +1,198 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+var errNoSuchEntry = errors.New("No such file in zip")
+
+// findZipEntry returns the file of a zip with the given name
+func findZipEntry(zipReader *zip.Reader, name string) (*zip.File, error) {
+	for _, file := range zipReader.File {
+		if file.Name == name {
+			return file, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", errNoSuchEntry, name)
+}
+
+// selectZipEntries returns the files of a zip with the given names, in zip
+// order, failing if any is missing
+func selectZipEntries(zipReader *zip.Reader, names []string) ([]*zip.File, error) {
+	wanted := map[string]bool{}
+	for _, name := range names {
+		wanted[name] = false
+	}
+
+	selected := []*zip.File{}
+	for _, file := range zipReader.File {
+		if found, ok := wanted[file.Name]; ok && !found {
+			wanted[file.Name] = true
+			selected = append(selected, file)
+		}
+	}
+
+	for _, name := range names {
+		if !wanted[name] {
+			return nil, fmt.Errorf("%w: %s", errNoSuchEntry, name)
+		}
+	}
+
+	return selected, nil
+}
+
+// fetchZipEntryData fetches the compressed data of a file of a zip stored at
+// bucket/key, counted as downloaded for operation
+func fetchZipEntryData(ctx context.Context, storage Storage, bucket, key string, file *zip.File, operation string) (io.ReadCloser, error) {
+	// a range can't be empty
+	if file.CompressedSize64 == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	offset, err := file.DataOffset()
+	if err != nil {
+		return nil, err
+	}
+
+	body, _, err := storage.GetFileRange(ctx, bucket, key, offset, int64(file.CompressedSize64))
+	if err != nil {
+		return nil, err
+	}
+	metrics.downloadedBytes.WithLabelValues(operation).Add(float64(file.CompressedSize64))
+	return body, nil
+}
+
+// openZipEntry reads a file of a zip stored at bucket/key with a single range
+// request for its data, counted as downloaded for operation
+func openZipEntry(ctx context.Context, storage Storage, bucket, key string, file *zip.File, operation string) (io.ReadCloser, error) {
+	body, err := fetchZipEntryData(ctx, storage, bucket, key, file, operation)
+	if err != nil {
+		return nil, err
+	}
+
+	var reader io.Reader
+	switch file.Method {
+	case zip.Store:
+		reader = body
+	case zip.Deflate:
+		reader = flate.NewReader(body)
+	default:
+		body.Close()
+		return nil, zip.ErrAlgorithm
+	}
+
+	return readCloser{checksummedReader(reader, file.CRC32), body}, nil
+}
+
+// streamZipEntry writes a file of the zip at bucket/key to w, with the
+// content type and encoding extracting it would upload it with. Only the
+// central directory and the file itself are downloaded. Returns whether the
+// response was started, after which errors can't be reported to the client.
+func streamZipEntry(ctx context.Context, storage Storage, bucket, key, name string, maxFileSize uint64, w http.ResponseWriter) (bool, error) {
+	readerAt, err := newRangedReaderAt(ctx, func(ctx context.Context, offset, length int64) (io.ReadCloser, int64, error) {
+		return storage.GetFileRange(ctx, bucket, key, offset, length)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	defer func() {
+		metrics.downloadedBytes.WithLabelValues("entry").Add(float64(readerAt.bytesFetched()))
+	}()
+
+	zipReader, err := zip.NewReader(readerAt, readerAt.size)
+	if err != nil {
+		return false, err
+	}
+
+	file, err := findZipEntry(zipReader, name)
+	if err != nil {
+		return false, err
+	}
+
+	return writeZipEntry(ctx, storage, bucket, key, file, "", maxFileSize, w, "entry")
+}
+
+// writeZipEntry writes a file of the zip at bucket/key to w, along with the
+// content type and encoding extracting it would upload it with. If name isn't
+// empty, it's what the file was asked for as, and it must be what extracting
+// it would name it once rewrite rules are applied. Returns whether the
+// response was started.
+func writeZipEntry(ctx context.Context, storage Storage, bucket, key string, file *zip.File, name string, maxFileSize uint64, w http.ResponseWriter, operation string) (bool, error) {
+	if file.UncompressedSize64 > maxFileSize {
+		return false, limitExceeded("File too large (max %d bytes)", maxFileSize)
+	}
+
+	reader, err := openZipEntry(ctx, storage, bucket, key, file, operation)
+	if err != nil {
+		return false, err
+	}
+	defer reader.Close()
+
+	var totalBytes uint64
+	limited := limitedReader(reader, maxFileSize, &totalBytes)
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(limited, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	head = head[:n]
+
+	resource := newResourceSpec(file.Name, head)
+	if name != "" && resource.key != name {
+		// eg. a .jsgz that isn't gzipped, which extraction wouldn't rename
+		return false, fmt.Errorf("%w: %s", errNoSuchEntry, name)
+	}
+
+	w.Header().Set("Content-Type", resource.contentType)
+	if resource.contentEncoding != "" {
+		w.Header().Set("Content-Encoding", resource.contentEncoding)
+	}
+	w.Header().Set("Content-Length", strconv.FormatUint(file.UncompressedSize64, 10))
+	w.WriteHeader(http.StatusOK)
+
+	_, err = w.Write(head)
+	if err != nil {
+		return true, err
+	}
+
+	_, err = io.Copy(w, limited)
+	return true, err
+}
+
+// entryHandler streams a single file out of a zip in the bucket, from
+// GET /entry?key=...&file=...
+func entryHandler(w http.ResponseWriter, r *http.Request) error {
+	req, err := parseEntryRequest(r)
+	if err != nil {
+		metrics.operations.WithLabelValues("entry", outcomeLabel(err)).Inc()
+		return err
+	}
+
+	storage, err := newStorage(config)
+	if storage == nil {
+		return err
+	}
+
+	started, err := streamZipEntry(r.Context(), storage, config.Bucket, req.Key, req.File, config.MaxFileSize, w)
+	metrics.operations.WithLabelValues("entry", outcomeLabel(err)).Inc()
+
+	if err != nil {
+		loggerFrom(r.Context()).Errorf("Streaming %s from %s failed: %s", req.File, req.Key, err.Error())
+		if started {
+			// too late for an error response, the client sees a truncated body
+			return nil
+		}
+		return writeJSONError(w, "EntryError", err)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_StreamZipEntry(t *testing.T) {
+	ctx := context.Background()
+	memStorage, err := NewMemStorage()
+	assert.NoError(t, err)
+	storage := &rangeCountingStorage{MemStorage: memStorage}
+
+	html := []byte("<!doctype html><html><body>" + strings.Repeat("hello ", 1000) + "</body></html>")
+	gzipped := []byte{0x1F, 0x8B, 0x08, 3, 7, 3, 4, 12, 53, 26, 34}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, entry := range []struct {
+		name   string
+		method uint16
+		data   []byte
+	}{
+		{"index.html", zip.Deflate, html},
+		{"game.jsgz", zip.Store, gzipped},
+		{"empty.txt", zip.Store, nil},
+	} {
+		writer, err := zw.CreateHeader(&zip.FileHeader{Name: entry.name, Method: entry.method})
+		assert.NoError(t, err)
+		_, err = writer.Write(entry.data)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, zw.Close())
+	assert.NoError(t, storage.PutFile(ctx, "bucket", "game.zip", bytes.NewReader(buf.Bytes()), "application/zip"))
+
+	rec := httptest.NewRecorder()
+	started, err := streamZipEntry(ctx, storage, "bucket", "game.zip", "index.html", 1024*1024, rec)
+	assert.NoError(t, err)
+	assert.True(t, started)
+	assert.EqualValues(t, "text/html; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.EqualValues(t, "", rec.Header().Get("Content-Encoding"))
+	assert.EqualValues(t, html, rec.Body.Bytes(), "deflated entries are inflated")
+
+	rec = httptest.NewRecorder()
+	_, err = streamZipEntry(ctx, storage, "bucket", "game.zip", "game.jsgz", 1024*1024, rec)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.EqualValues(t, gzipped, rec.Body.Bytes(), "gzipped content is served as is")
+
+	// an empty range can't be asked for, there's nothing to fetch anyway
+	ranges := storage.ranges
+	rec = httptest.NewRecorder()
+	_, err = streamZipEntry(ctx, storage, "bucket", "game.zip", "empty.txt", 1024*1024, rec)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "0", rec.Header().Get("Content-Length"))
+	assert.EqualValues(t, 0, rec.Body.Len())
+	assert.EqualValues(t, ranges+1, storage.ranges, "only the central directory is fetched")
+
+	started, err = streamZipEntry(ctx, storage, "bucket", "game.zip", "missing.txt", 1024*1024, httptest.NewRecorder())
+	assert.False(t, started)
+	assert.EqualValues(t, http.StatusNotFound, statusCodeFor(err))
+
+	_, err = streamZipEntry(ctx, storage, "bucket", "game.zip", "index.html", 100, httptest.NewRecorder())
+	assert.EqualValues(t, http.StatusUnprocessableEntity, statusCodeFor(err))
+
+	_, err = streamZipEntry(ctx, storage, "bucket", "nope.zip", "index.html", 100, httptest.NewRecorder())
+	assert.EqualValues(t, http.StatusNotFound, statusCodeFor(err))
+}
+
+func Test_ExtractOnlyFiles(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+	storage, err := NewMemStorage()
+	assert.NoError(t, err)
+	archiver := &Archiver{storage, config}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	zl := &zipLayout{
+		entries: []zipEntry{
+			zipEntry{name: "index.html", data: []byte("hi")},
+			zipEntry{name: "img/a.png", data: []byte("aaa")},
+			zipEntry{name: "img/b.png", data: []byte("bbb")},
+		},
+	}
+	zl.Write(t, zw)
+	assert.NoError(t, zw.Close())
+	assert.NoError(t, storage.PutFile(ctx, config.Bucket, "subset.zip", bytes.NewReader(buf.Bytes()), "application/zip"))
+
+	limits := testLimits()
+	limits.OnlyFiles = []string{"img/b.png", "index.html"}
+	// only the selection counts
+	limits.MaxNumFiles = 2
+
+	extracted, err := archiver.ExtractZip(ctx, "subset.zip", "subset", limits)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, len(extracted))
+
+	_, err = storage.GetFile(ctx, config.Bucket, "subset/img/a.png")
+	assert.Error(t, err, "files left out aren't extracted")
+	_, err = storage.GetFile(ctx, config.Bucket, "subset/img/b.png")
+	assert.NoError(t, err)
+
+	limits.OnlyFiles = []string{"index.html", "nope.html"}
+	_, err = archiver.ExtractZip(ctx, "subset.zip", "subset2", limits)
+	assert.EqualValues(t, http.StatusNotFound, statusCodeFor(err))
+	_, err = storage.GetFile(ctx, config.Bucket, "subset2/index.html")
+	assert.Error(t, err, "nothing is extracted if a file is missing")
+}
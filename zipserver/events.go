@@ -0,0 +1,178 @@
+package zipserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sseKeepAlive is how often an idle event stream gets a comment, so proxies
+// don't close it
+const sseKeepAlive = 15 * time.Second
+
+// FileEvent is sent as each file of an extraction is uploaded, skipped or
+// fails
+type FileEvent struct {
+	// name of the entry in the zip
+	File  string `json:",omitempty"`
+	Key   string `json:",omitempty"`
+	Size  uint64 `json:",omitempty"`
+	Error string `json:",omitempty"`
+}
+
+// JobSummary is the last event of an extraction
+type JobSummary struct {
+	Success       bool
+	Error         string `json:",omitempty"`
+	FilesUploaded int
+	Progress      Progress
+}
+
+type jobEvent struct {
+	name string
+	data interface{}
+}
+
+// eventLog records the events of a job so they can be streamed to any number
+// of clients, including ones showing up late. A nil log ignores events.
+type eventLog struct {
+	sync.Mutex
+	events []jobEvent
+	closed bool
+	// closed and replaced whenever something happens
+	changed chan struct{}
+}
+
+func newEventLog() *eventLog {
+	return &eventLog{changed: make(chan struct{})}
+}
+
+func (el *eventLog) publish(name string, data interface{}) {
+	if el == nil {
+		return
+	}
+
+	el.Lock()
+	defer el.Unlock()
+
+	if el.closed {
+		return
+	}
+
+	el.events = append(el.events, jobEvent{name, data})
+	close(el.changed)
+	el.changed = make(chan struct{})
+}
+
+// close marks the end of the log, after the summary
+func (el *eventLog) close() {
+	el.Lock()
+	defer el.Unlock()
+
+	if el.closed {
+		return
+	}
+
+	el.closed = true
+	close(el.changed)
+}
+
+// since returns the events recorded from index on, whether the log is
+// closed, and a channel closed when there's more to read
+func (el *eventLog) since(index int) ([]jobEvent, bool, <-chan struct{}) {
+	el.Lock()
+	defer el.Unlock()
+
+	if index < 0 {
+		index = 0
+	}
+
+	var events []jobEvent
+	if index < len(el.events) {
+		events = el.events[index:]
+	}
+	return events, el.closed, el.changed
+}
+
+// withEvents returns a copy of ctx that file events are published to
+func withEvents(ctx context.Context, el *eventLog) context.Context {
+	return context.WithValue(ctx, eventsKey, el)
+}
+
+// eventsFrom returns the log file events should be published to, nil if
+// nobody's interested
+func eventsFrom(ctx context.Context) *eventLog {
+	el, _ := ctx.Value(eventsKey).(*eventLog)
+	return el
+}
+
+// jobEventsHandler streams the events of an extraction as Server-Sent
+// Events, from GET /jobs/{id}/events. Clients reconnecting with
+// Last-Event-ID pick up where they left off.
+func jobEventsHandler(w http.ResponseWriter, r *http.Request) error {
+	jobID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/events")
+	if jobID == "" || strings.Contains(jobID, "/") || !strings.HasSuffix(r.URL.Path, "/events") {
+		http.NotFound(w, r)
+		return nil
+	}
+
+	job := findJob(jobID)
+	if job == nil {
+		return writeJSONError(w, "StatusError", fmt.Errorf("%w: %s", errUnknownJob, jobID))
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return errors.New("Streaming not supported")
+	}
+
+	index := 0
+	if lastID, err := strconv.Atoi(r.Header.Get("Last-Event-ID")); err == nil && lastID >= 0 {
+		index = lastID + 1
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		events, closed, changed := job.events.since(index)
+		for _, event := range events {
+			data, err := json.Marshal(event.data)
+			if err != nil {
+				return err
+			}
+
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", index, event.name, data)
+			if err != nil {
+				// client went away
+				return nil
+			}
+			index++
+		}
+		flusher.Flush()
+
+		if closed {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package zipserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type sseEvent struct {
+	id, name, data string
+}
+
+// readEvents reads a Server-Sent Events stream until it ends
+func readEvents(t *testing.T, res *http.Response) []sseEvent {
+	events := []sseEvent{}
+	current := sseEvent{}
+
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if current.name != "" {
+				events = append(events, current)
+			}
+			current = sseEvent{}
+		case strings.HasPrefix(line, "id: "):
+			current.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			current.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			current.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+	assert.NoError(t, scanner.Err())
+
+	return events
+}
+
+func Test_JobEvents(t *testing.T) {
+	ts := httptest.NewServer(errorHandler(jobEventsHandler))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/jobs/unknown-job/events")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.NotEqual(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	job, started := startOrJoinJob(jobKey{key: "events.zip", prefix: "events"}, "", "events-job", 0)
+	assert.True(t, started)
+
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		job.run(context.Background(), func(ctx context.Context) ([]ExtractedFile, error) {
+			events := eventsFrom(ctx)
+			events.publish("skipped", FileEvent{File: "__MACOSX/junk"})
+			events.publish("uploaded", FileEvent{Key: "events/1", Size: 3})
+			<-release
+			events.publish("failed", FileEvent{Key: "events/2", Error: "boom"})
+			return nil, errors.New("boom")
+		})
+	}()
+
+	res, err = http.Get(ts.URL + "/jobs/" + job.id + "/events")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.EqualValues(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	// the stream follows the job as it runs
+	close(release)
+	events := readEvents(t, res)
+	<-finished
+
+	names := []string{}
+	for _, event := range events {
+		names = append(names, event.name)
+	}
+	assert.EqualValues(t, []string{"skipped", "uploaded", "failed", "summary"}, names)
+
+	var uploaded FileEvent
+	assert.NoError(t, json.Unmarshal([]byte(events[1].data), &uploaded))
+	assert.EqualValues(t, FileEvent{Key: "events/1", Size: 3}, uploaded)
+
+	var summary JobSummary
+	assert.NoError(t, json.Unmarshal([]byte(events[3].data), &summary))
+	assert.False(t, summary.Success)
+	assert.EqualValues(t, "boom", summary.Error)
+
+	// resuming after the second event
+	req, err := http.NewRequest("GET", ts.URL+"/jobs/"+job.id+"/events", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Last-Event-ID", events[1].id)
+
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+
+	resumed := readEvents(t, res)
+	if assert.EqualValues(t, 2, len(resumed)) {
+		assert.EqualValues(t, "failed", resumed[0].name)
+		assert.EqualValues(t, "summary", resumed[1].name)
+	}
+
+	// invalid IDs replay everything
+	for _, lastID := range []string{"-5", "garbage"} {
+		req.Header.Set("Last-Event-ID", lastID)
+		res, err = http.DefaultClient.Do(req)
+		if assert.NoError(t, err) {
+			assert.EqualValues(t, 4, len(readEvents(t, res)), lastID)
+			res.Body.Close()
+		}
+	}
+
+	all, _, _ := job.events.since(-4)
+	assert.EqualValues(t, 4, len(all))
+}
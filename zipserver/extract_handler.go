@@ -1,156 +1,456 @@
 package zipserver
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
+	"path"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 var shared struct {
-	// maps aren't thread-safe in golang, this protects openKeys
+	// maps aren't thread-safe in golang, this protects lockedPrefixes and jobs
 	sync.Mutex
-	// empty struct is zero-width, we're using that map as a set (no values)
-	openKeys map[string]struct{}
+	// destination prefixes currently being written to, each with a channel
+	// closed when it's released
+	lockedPrefixes map[string]chan struct{}
+	// extractions currently running
+	jobs map[jobKey]*extractJob
+	// extractions running or recently finished, for status queries
+	jobsByID map[string]*extractJob
 }
 
 func init() {
-	shared.openKeys = make(map[string]struct{})
+	shared.lockedPrefixes = make(map[string]chan struct{})
+	shared.jobs = make(map[jobKey]*extractJob)
+	shared.jobsByID = make(map[string]*extractJob)
 }
 
-// tryLockKey tries acquiring the lock for a given key
-// it returns true if we successfully acquired the lock,
-// false if the key is locked by someone else
-func tryLockKey(key string) bool {
+// prefixesOverlap returns true if writing to one of the prefixes could
+// write into the other one, ie. if they're equal or one contains the other
+func prefixesOverlap(a, b string) bool {
+	if a == "." || b == "." {
+		return true
+	}
+
+	return a == b || strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
+
+// tryLockPrefixLocked is tryLockPrefix for callers already holding shared.
+// When the prefix can't be locked, it returns the channel of an overlapping
+// prefix to wait on.
+func tryLockPrefixLocked(prefix string) (bool, chan struct{}) {
+	for locked, released := range shared.lockedPrefixes {
+		if prefixesOverlap(prefix, locked) {
+			return false, released
+		}
+	}
+
+	shared.lockedPrefixes[prefix] = make(chan struct{})
+	return true, nil
+}
+
+// tryLockPrefix tries acquiring the write lock for a destination prefix
+// it returns true if we successfully acquired the lock, false if that prefix,
+// a parent or a child of it is being written to by someone else
+func tryLockPrefix(prefix string) bool {
 	shared.Lock()
 	defer shared.Unlock()
 
-	// test for key existence
-	if _, ok := shared.openKeys[key]; ok {
-		// locked by someone else
-		return false
+	locked, _ := tryLockPrefixLocked(path.Clean(prefix))
+	return locked
+}
+
+// lockPrefix acquires the write lock for a destination prefix, waiting for
+// any overlapping writer to be done. Fails if ctx is done first.
+func lockPrefix(ctx context.Context, prefix string) error {
+	prefix = path.Clean(prefix)
+
+	for contended := false; ; contended = true {
+		shared.Lock()
+		locked, released := tryLockPrefixLocked(prefix)
+		shared.Unlock()
+		if locked {
+			return nil
+		}
+
+		if !contended {
+			metrics.lockContentions.Inc()
+		}
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return fmt.Errorf("Waiting for %s to be released: %w", prefix, abortReason(ctx))
+		}
 	}
-	shared.openKeys[key] = struct{}{}
-	return true
 }
 
-func releaseKey(key string) {
+func releasePrefix(prefix string) {
 	shared.Lock()
 	defer shared.Unlock()
 
-	// delete key from map so the map doesn't keep growing
-	delete(shared.openKeys, key)
+	releasePrefixLocked(prefix)
 }
 
-func loadLimits(params url.Values, config *Config) *ExtractLimits {
-	limits := DefaultExtractLimits(config)
+// releasePrefixLocked is releasePrefix for callers already holding shared
+func releasePrefixLocked(prefix string) {
+	prefix = path.Clean(prefix)
+	if released, ok := shared.lockedPrefixes[prefix]; ok {
+		delete(shared.lockedPrefixes, prefix)
+		close(released)
+	}
+}
+
+// jobKey identifies an extraction: a given source zip going to a given
+// prefix, under given limits
+type jobKey struct {
+	key    string
+	prefix string
+	// the files extracted if not all of them, sorted and joined by newlines
+	files string
+	// requests asking for other limits don't share the job, they queue
+	// behind it for the prefix
+	limits jobLimits
+}
+
+// jobLimits are the ExtractLimits a job runs with, in a comparable form
+type jobLimits struct {
+	maxFileSize       uint64
+	maxTotalSize      uint64
+	maxNumFiles       int
+	maxFileNameLength int
+	extractionThreads int
+	jobTimeout        time.Duration
+	downloadTimeout   time.Duration
+	fileTimeout       time.Duration
+}
 
-	{
-		maxFileSize, err := getUint64Param(params, "maxFileSize")
-		if err == nil {
-			limits.MaxFileSize = maxFileSize
+func newJobKey(key, prefix string, limits *ExtractLimits) jobKey {
+	sorted := append([]string{}, limits.OnlyFiles...)
+	sort.Strings(sorted)
+	return jobKey{key, prefix, strings.Join(sorted, "\n"), jobLimits{
+		maxFileSize:       limits.MaxFileSize,
+		maxTotalSize:      limits.MaxTotalSize,
+		maxNumFiles:       limits.MaxNumFiles,
+		maxFileNameLength: limits.MaxFileNameLength,
+		extractionThreads: limits.ExtractionThreads,
+		jobTimeout:        limits.JobTimeout,
+		downloadTimeout:   limits.DownloadTimeout,
+		fileTimeout:       limits.FileTimeout,
+	}}
+}
+
+// jobCallback is an async URL to notify when a job is done, along with the
+// ID of the request that asked for it
+type jobCallback struct {
+	url       string
+	requestID string
+
+	// how often to post progress while the job runs, 0 for never
+	progressInterval time.Duration
+	progressSentAt   time.Time
+	progressVersion  uint64
+}
+
+// extractJob is a single extraction in flight. Concurrent requests for the
+// same key and prefix share it instead of being turned away.
+type extractJob struct {
+	jobKey
+	// generated when the job starts, not taken from the client, so a job
+	// can only be looked up or canceled by whoever was told its ID
+	id string
+
+	// closed once files and err are set
+	done  chan struct{}
+	files []ExtractedFile
+	err   error
+
+	progress *progressTracker
+	events   *eventLog
+
+	// guarded by shared
+	callbacks []jobCallback
+	// sync requests waiting for the result
+	waiters int
+	// why the job was canceled, if it was
+	canceled error
+	// cancels the extraction once it's running
+	abort func(reason error)
+	// whether we got the prefix lock and are extracting
+	running bool
+}
+
+// startOrJoinJob returns the job for jk, registering
+// asyncURL (if any) to be notified when it's done, and of its progress every
+// progressInterval. If there was no such job yet, a new one is created and
+// started is true: the caller must run it.
+func startOrJoinJob(jk jobKey, asyncURL, requestID string, progressInterval time.Duration) (job *extractJob, started bool) {
+	shared.Lock()
+	defer shared.Unlock()
+
+	job, ok := shared.jobs[jk]
+	if !ok {
+		job = &extractJob{
+			jobKey:   jk,
+			id:       newID(),
+			done:     make(chan struct{}),
+			progress: &progressTracker{},
+			events:   newEventLog(),
 		}
+		shared.jobs[jk] = job
+		shared.jobsByID[job.id] = job
+		started = true
 	}
 
-	{
-		maxTotalSize, err := getUint64Param(params, "maxTotalSize")
-		if err == nil {
-			limits.MaxTotalSize = maxTotalSize
-		}
+	if asyncURL != "" {
+		job.callbacks = append(job.callbacks, jobCallback{
+			url:              asyncURL,
+			requestID:        requestID,
+			progressInterval: progressInterval,
+		})
+	} else {
+		job.waiters++
 	}
 
-	{
-		maxNumFiles, err := getIntParam(params, "maxNumFiles")
-		if err == nil {
-			limits.MaxNumFiles = maxNumFiles
-		}
+	return job, started
+}
+
+// cancelLocked is cancel for callers already holding shared
+func (job *extractJob) cancelLocked(reason error) {
+	if job.canceled != nil {
+		return
 	}
+	job.canceled = reason
 
-	{
-		maxFileNameLength, err := getIntParam(params, "maxFileNameLength")
-		if err == nil {
-			limits.MaxFileNameLength = maxFileNameLength
-		}
+	// requests coming after this get a fresh job
+	if shared.jobs[job.jobKey] == job {
+		delete(shared.jobs, job.jobKey)
 	}
 
-	return limits
+	if job.abort != nil {
+		job.abort(reason)
+	}
 }
 
-func extractHandler(w http.ResponseWriter, r *http.Request) error {
-	params := r.URL.Query()
-	key, err := getParam(params, "key")
+// cancel aborts the extraction, whether it's running yet or not
+func (job *extractJob) cancel(reason error) {
+	shared.Lock()
+	defer shared.Unlock()
+
+	job.cancelLocked(reason)
+}
+
+// run waits for exclusive access to the destination prefix, performs the
+// extraction, then hands the result to everyone waiting on the job
+func (job *extractJob) run(ctx context.Context, process func(ctx context.Context) ([]ExtractedFile, error)) {
+	ctx, abort := withAbort(ctx)
+	defer abort(nil)
+
+	shared.Lock()
+	job.abort = abort
+	if job.canceled != nil {
+		abort(job.canceled)
+	}
+	shared.Unlock()
+
+	defer registerCancelable(job.id, job.cancel)()
+
+	logger := loggerFrom(ctx)
+	logger.Infof("Extracting %s to %s", job.key, job.prefix)
+
+	var files []ExtractedFile
+	err := lockPrefix(ctx, job.prefix)
+	locked := err == nil
+	if locked {
+		shared.Lock()
+		job.running = true
+		shared.Unlock()
+
+		ctx = withProgress(ctx, job.progress)
+		ctx = withEvents(ctx, job.events)
+		stopProgress := job.reportProgress(ctx)
+
+		doneInFlight := trackInFlight("extract")
+		files, err = process(ctx)
+		doneInFlight()
+
+		// the final callback must be the last one
+		stopProgress()
+	}
+	metrics.operations.WithLabelValues("extract", outcomeLabel(err)).Inc()
+
+	shared.Lock()
+	job.files = files
+	job.err = err
+	callbacks := job.callbacks
+	if shared.jobs[job.jobKey] == job {
+		delete(shared.jobs, job.jobKey)
+	}
+	if locked {
+		releasePrefixLocked(job.prefix)
+	}
+	close(job.done)
+	shared.Unlock()
+	forgetJobLater(job)
+
+	summary := JobSummary{Success: err == nil, FilesUploaded: len(files)}
+	summary.Progress, _ = job.progress.snapshot()
 	if err != nil {
-		return err
+		summary.Error = err.Error()
 	}
+	job.events.publish("summary", summary)
+	job.events.close()
 
-	prefix, err := getParam(params, "prefix")
 	if err != nil {
-		return err
+		logger.Errorf("Extraction failed: %s", err.Error())
+	} else {
+		logger.Infof("Extraction done")
 	}
 
-	hasLock := tryLockKey(key)
-	if !hasLock {
-		// already being extracted in another handler, ask consumer to wait
-		return writeJSONMessage(w, struct{ Processing bool }{true})
+	if len(callbacks) == 0 {
+		return
 	}
 
-	limits := loadLimits(params, config)
+	resValues := url.Values{}
+	resValues.Add("JobID", job.id)
+
+	if err != nil {
+		addErrorValues(resValues, "ExtractError", err)
+	} else {
+		resValues.Add("Success", "true")
+		addExtractedFilesValues(resValues, files)
+	}
 
-	process := func() ([]ExtractedFile, error) {
-		archiver := NewArchiver(config)
-		files, err := archiver.ExtractZip(key, prefix, limits)
+	for _, callback := range callbacks {
+		notifyCallback(ctx, callback, resValues)
+	}
+}
 
-		return files, err
+// addExtractedFilesValues lists extracted files in the values posted to
+// async callbacks
+func addExtractedFilesValues(values url.Values, files []ExtractedFile) {
+	for idx, extractedFile := range files {
+		values.Add(fmt.Sprintf("ExtractedFiles[%d][Key])", idx+1),
+			extractedFile.Key)
+		values.Add(fmt.Sprintf("ExtractedFiles[%d][Size])", idx+1),
+			fmt.Sprintf("%v", extractedFile.Size))
 	}
+}
 
-	// sync codepath
-	asyncURL := params.Get("async")
-	if asyncURL == "" {
-		defer releaseKey(key)
+// wait blocks until the job is done and returns its result. If ctx is done
+// first (the client went away), the caller stops waiting, and the job is
+// canceled if nobody else is waiting on it.
+func (job *extractJob) wait(ctx context.Context) ([]ExtractedFile, error) {
+	select {
+	case <-job.done:
+		return job.files, job.err
+	case <-ctx.Done():
+	}
 
-		extracted, err := process()
-		if err != nil {
-			return writeJSONError(w, "ExtractError", err)
-		}
+	shared.Lock()
+	defer shared.Unlock()
 
-		return writeJSONMessage(w, struct {
-			Success        bool
-			ExtractedFiles []ExtractedFile
-		}{true, extracted})
+	job.waiters--
+	if job.waiters == 0 && len(job.callbacks) == 0 {
+		loggerFrom(ctx).With("job_id", job.id).Warnf("Nobody is waiting on the extraction anymore, canceling it")
+		job.cancelLocked(errClientGone)
 	}
+	return nil, errClientGone
+}
 
-	// async codepath
-	go (func() {
-		defer releaseKey(key)
+// callbackClient delivers async callbacks, a receiver that doesn't answer
+// shouldn't hold a job forever
+var callbackClient = &http.Client{Timeout: 30 * time.Second}
 
-		extracted, err := process()
-		resValues := url.Values{}
+// notifyCallback posts the result of an async operation to a callback URL,
+// along with the ID of the request that registered it
+func notifyCallback(ctx context.Context, callback jobCallback, resValues url.Values) {
+	values := url.Values{}
+	for k, vv := range resValues {
+		values[k] = vv
+	}
+	values.Set("RequestID", callback.requestID)
+
+	logger := loggerFrom(ctx).With("callback_request_id", callback.requestID)
+	logger.Infof("Notifying %s", callback.url)
+	asyncResponse, err := callbackClient.PostForm(callback.url, values)
+	if err == nil {
+		asyncResponse.Body.Close()
+	} else {
+		logger.Errorf("Failed to deliver callback: %s", err.Error())
+	}
+}
+
+func loadLimits(params url.Values, config *Config) *ExtractLimits {
+	lp := queryLimitsParams(params)
+	return lp.limits(config)
+}
+
+func extractHandler(w http.ResponseWriter, r *http.Request) error {
+	req, err := parseExtractRequest(r)
+	if err != nil {
+		return err
+	}
+
+	key := req.Key
+	// foo and foo/ are the same destination, for both jobs and locks
+	prefix := path.Clean(req.Prefix)
+	asyncURL := req.Callback.URL
+	progressInterval := seconds(req.Callback.ProgressInterval)
+
+	limits := req.Limits.limits(config)
+	limits.OnlyFiles = req.Files
+
+	jk := newJobKey(key, prefix, limits)
+	job, started := startOrJoinJob(jk, asyncURL, requestIDFrom(r.Context()), progressInterval)
+
+	if started {
+		ctx, done, err := beginWork()
 
 		if err != nil {
-			resValues.Add("Type", "ExtractError")
-			resValues.Add("Error", err.Error())
+			// shutting down, fail the job so everyone waiting on it hears about it
+			ctx = jobContext(context.Background(), r, job.id)
+			go job.run(ctx, func(context.Context) ([]ExtractedFile, error) { return nil, err })
 		} else {
-			resValues.Add("Success", "true")
-			for idx, extractedFile := range extracted {
-				resValues.Add(fmt.Sprintf("ExtractedFiles[%d][Key])", idx+1),
-					extractedFile.Key)
-				resValues.Add(fmt.Sprintf("ExtractedFiles[%d][Size])", idx+1),
-					fmt.Sprintf("%v", extractedFile.Size))
-			}
+			ctx = jobContext(ctx, r, job.id)
+			go func() {
+				defer done()
+				job.run(ctx, func(ctx context.Context) ([]ExtractedFile, error) {
+					ctx, stop := withTimeout(ctx, "extraction", limits.JobTimeout)
+					defer stop()
+
+					archiver := NewArchiver(config)
+					return archiver.ExtractZip(ctx, key, prefix, limits)
+				})
+			}()
 		}
+	} else {
+		loggerFrom(r.Context()).With("job_id", job.id).Infof("Joining extraction of %s to %s", key, prefix)
+	}
 
-		log.Print("Notifying " + asyncURL)
-		asyncResponse, err := http.PostForm(asyncURL, resValues)
-		if err == nil {
-			asyncResponse.Body.Close()
-		} else {
-			log.Print("Failed to deliver callback: " + err.Error())
+	// sync codepath: wait for the job, whoever started it
+	if asyncURL == "" {
+		extracted, err := job.wait(r.Context())
+		if err != nil {
+			return writeJSONError(w, "ExtractError", err)
 		}
-	})()
 
+		return writeJSONMessage(w, struct {
+			Success        bool
+			JobID          string
+			ExtractedFiles []ExtractedFile
+		}{true, job.id, extracted})
+	}
+
+	// async codepath: the job notifies asyncURL when it's done
 	return writeJSONMessage(w, struct {
 		Processing bool
 		Async      bool
-	}{true, true})
+		JobID      string
+	}{true, true, job.id})
 }
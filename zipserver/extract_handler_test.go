@@ -1,31 +1,74 @@
 package zipserver
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func Test_Locks(t *testing.T) {
 	// not the best test, more like a basic sanity check
-	hasLock := tryLockKey("foo")
+	hasLock := tryLockPrefix("foo")
 
 	assert.True(t, hasLock, "should acquire foo")
 
-	hasLock = tryLockKey("foo")
+	hasLock = tryLockPrefix("foo/")
 	assert.False(t, hasLock, "should not acquire foo again")
 
-	hasLock = tryLockKey("bar")
-	assert.True(t, hasLock, "should acquire bar")
+	hasLock = tryLockPrefix("foo/sub")
+	assert.False(t, hasLock, "should not acquire a prefix inside foo")
 
-	releaseKey("foo")
-	hasLock = tryLockKey("bar")
-	assert.False(t, hasLock, "should not acquire bar again")
+	hasLock = tryLockPrefix("foobar")
+	assert.True(t, hasLock, "should acquire foobar")
 
-	hasLock = tryLockKey("foo")
+	hasLock = tryLockPrefix("bar/sub")
+	assert.True(t, hasLock, "should acquire bar/sub")
+
+	hasLock = tryLockPrefix("bar")
+	assert.False(t, hasLock, "should not acquire a parent of bar/sub")
+
+	releasePrefix("foo")
+	hasLock = tryLockPrefix("foobar")
+	assert.False(t, hasLock, "should not acquire foobar again")
+
+	hasLock = tryLockPrefix("foo")
 	assert.True(t, hasLock, "should acquire foo again")
+
+	acquired := make(chan error)
+	go func() {
+		acquired <- lockPrefix(context.Background(), "foo/sub")
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("lockPrefix should wait while foo is locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	releasePrefix("foo")
+	assert.NoError(t, <-acquired)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		acquired <- lockPrefix(ctx, "foo")
+	}()
+	cancel()
+	assert.ErrorIs(t, <-acquired, context.Canceled, "waiting stops with ctx")
+	assert.False(t, tryLockPrefix("foo"), "foo/sub is still locked")
+
+	releasePrefix("foo/sub")
+	releasePrefix("foobar")
+	releasePrefix("bar/sub")
 }
 
 func Test_Limits(t *testing.T) {
@@ -40,4 +83,213 @@ func Test_Limits(t *testing.T) {
 
 	el = loadLimits(values, &defaultConfig)
 	assert.EqualValues(t, el.MaxFileSize, customMaxFileSize)
+	assert.EqualValues(t, el.JobTimeout, time.Duration(defaultConfig.JobTimeout)*time.Second)
+
+	values, err = url.ParseQuery("jobTimeout=5&fileTimeout=2")
+	assert.NoError(t, err)
+
+	el = loadLimits(values, &defaultConfig)
+	assert.EqualValues(t, el.JobTimeout, 5*time.Second)
+	assert.EqualValues(t, el.FileTimeout, 2*time.Second)
+	assert.EqualValues(t, el.DownloadTimeout, time.Duration(defaultConfig.DownloadTimeout)*time.Second)
+}
+
+func Test_JobCoalescing(t *testing.T) {
+	callbacks := make(chan url.Values, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		callbacks <- r.PostForm
+	}))
+	defer ts.Close()
+
+	job, started := startOrJoinJob(jobKey{key: "coalesce.zip", prefix: "one"}, "", "test", 0)
+	assert.NotNil(t, job)
+	assert.True(t, started, "first request should start the job")
+
+	joined, started := startOrJoinJob(jobKey{key: "coalesce.zip", prefix: "one"}, ts.URL, "test", 0)
+	assert.True(t, job == joined, "same key and prefix should join the running job")
+	assert.False(t, started)
+
+	other, started := startOrJoinJob(jobKey{key: "coalesce.zip", prefix: "two"}, "", "test", 0)
+	assert.True(t, started, "same key with another prefix should be a separate job")
+	assert.False(t, job == other)
+	other.run(context.Background(), func(context.Context) ([]ExtractedFile, error) { return nil, nil })
+
+	strict := testLimits()
+	strict.MaxNumFiles = 1
+	stricter, started := startOrJoinJob(newJobKey("coalesce.zip", "one", strict), "", "test", 0)
+	assert.True(t, started, "other limits should be a separate job")
+	assert.False(t, job == stricter)
+	stricter.run(context.Background(), func(context.Context) ([]ExtractedFile, error) { return nil, nil })
+	assert.EqualValues(t, newJobKey("a.zip", "one", testLimits()), newJobKey("a.zip", "one", testLimits()))
+
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := joined.wait(context.Background())
+			results <- err
+		}()
+	}
+
+	job.run(context.Background(), func(context.Context) ([]ExtractedFile, error) {
+		return nil, errors.New("boom")
+	})
+
+	for i := 0; i < 2; i++ {
+		assert.EqualError(t, <-results, "boom", "every waiter gets the shared result")
+	}
+
+	values := <-callbacks
+	assert.EqualValues(t, "ExtractError", values.Get("Type"))
+	assert.EqualValues(t, "boom", values.Get("Error"))
+	assert.EqualValues(t, job.id, values.Get("JobID"))
+	assert.EqualValues(t, "test", values.Get("RequestID"), "request IDs are only passed along")
+	assert.NotEqual(t, "test", job.id)
+	assert.NotEqual(t, job.id, other.id, "jobs get their own IDs")
+
+	job, started = startOrJoinJob(jobKey{key: "coalesce.zip", prefix: "one"}, "", "test", 0)
+	assert.True(t, started, "a new job should start once the previous one is done")
+	job.run(context.Background(), func(context.Context) ([]ExtractedFile, error) { return nil, nil })
+}
+
+func Test_JobCancel(t *testing.T) {
+	// blocks until the job is canceled
+	process := func(ctx context.Context) ([]ExtractedFile, error) {
+		<-ctx.Done()
+		return nil, abortedError(ctx)
+	}
+
+	// the only client waiting goes away
+	job, started := startOrJoinJob(jobKey{key: "cancel.zip", prefix: "one"}, "", "gone", 0)
+	assert.True(t, started)
+	go job.run(context.Background(), process)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := job.wait(ctx)
+	assert.Equal(t, errClientGone, err)
+
+	_, err = job.wait(context.Background())
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "client disconnected"))
+
+	// somebody still wants the result, the job goes on
+	job, started = startOrJoinJob(jobKey{key: "cancel.zip", prefix: "one"}, "", "cancel-me", 0)
+	assert.True(t, started)
+	joined, _ := startOrJoinJob(jobKey{key: "cancel.zip", prefix: "one"}, "", "cancel-me", 0)
+	running := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		job.run(context.Background(), func(ctx context.Context) ([]ExtractedFile, error) {
+			close(running)
+			return process(ctx)
+		})
+		close(finished)
+	}()
+	<-running
+
+	_, err = joined.wait(ctx)
+	assert.Equal(t, errClientGone, err)
+	shared.Lock()
+	assert.Nil(t, job.canceled, "job should still be running")
+	shared.Unlock()
+
+	// until it's canceled explicitly
+	assert.False(t, cancelJob("unknown"))
+	assert.False(t, cancelJob("cancel-me"), "request IDs don't name jobs")
+	assert.True(t, cancelJob(job.id))
+	<-finished
+
+	_, err = job.wait(context.Background())
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "canceled by request"))
+	assert.False(t, cancelJob(job.id), "finished jobs can't be canceled")
+
+	rec := httptest.NewRecorder()
+	assert.NoError(t, cancelHandler(rec, httptest.NewRequest("GET", "/cancel?job="+job.id, nil)))
+	assert.EqualValues(t, http.StatusMethodNotAllowed, rec.Code)
+
+	rec = httptest.NewRecorder()
+	assert.NoError(t, cancelHandler(rec, httptest.NewRequest("POST", "/cancel?job="+job.id, nil)))
+	assert.EqualValues(t, http.StatusNotFound, rec.Code)
+}
+
+func Test_ExtractPrefixNormalized(t *testing.T) {
+	previousConfig := config
+	defer func() { config = previousConfig }()
+	config = emptyConfig()
+
+	// the job waits on the prefix, so it's still running when joined
+	assert.True(t, tryLockPrefix("normalized"))
+	defer releasePrefix("normalized")
+
+	extract := func(prefix string) string {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/extract?key=a.zip&async=http://127.0.0.1:0/done&prefix="+prefix, nil)
+		assert.NoError(t, extractHandler(rec, req))
+
+		var res struct{ JobID string }
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+		return res.JobID
+	}
+
+	first := extract("normalized/")
+	assert.NotEmpty(t, first)
+	assert.EqualValues(t, first, extract("normalized"), "a trailing slash shouldn't make another job")
+	shared.Lock()
+	job := shared.jobsByID[first]
+	shared.Unlock()
+	job.cancel(errCanceled)
+	_, err := job.wait(context.Background())
+	assert.Error(t, err)
+}
+
+func Test_PrefixWriters(t *testing.T) {
+	// each job holds its prefix until it's released
+	runAll := func(jobs ...jobKey) (chan string, chan struct{}, *sync.WaitGroup) {
+		running := make(chan string, len(jobs))
+		release := make(chan struct{})
+		var wg sync.WaitGroup
+		for _, jk := range jobs {
+			job, started := startOrJoinJob(jk, "", "test", 0)
+			assert.True(t, started)
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				job.run(context.Background(), func(context.Context) ([]ExtractedFile, error) {
+					running <- job.key
+					<-release
+					return nil, nil
+				})
+			}()
+		}
+		return running, release, &wg
+	}
+
+	running, release, wg := runAll(
+		jobKey{key: "a.zip", prefix: "dest"},
+		jobKey{key: "b.zip", prefix: "dest"},
+		jobKey{key: "c.zip", prefix: "dest/sub"},
+	)
+	<-running
+	select {
+	case key := <-running:
+		t.Fatalf("writers to the same prefix should be serialized, %s ran concurrently", key)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	wg.Wait()
+
+	running, release, wg = runAll(
+		jobKey{key: "a.zip", prefix: "one"},
+		jobKey{key: "a.zip", prefix: "two"},
+		jobKey{key: "a.zip", prefix: "three"},
+	)
+	// all of them get to run before any is released
+	for i := 0; i < 3; i++ {
+		<-running
+	}
+	close(release)
+	wg.Wait()
 }
@@ -1,11 +1,14 @@
 package zipserver
 
 import (
-	"errors"
+	"context"
+	"encoding/xml"
 	"io"
-	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"time"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
@@ -49,43 +52,136 @@ func NewGcsStorage(config *Config) (*GcsStorage, error) {
 	}, nil
 }
 
+// gcsTransport makes sure a connection to GCS that goes silent doesn't
+// hang forever. Whole operations are bounded by the timeouts in ExtractLimits.
+var gcsTransport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 60 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+	IdleConnTimeout:       90 * time.Second,
+	MaxIdleConnsPerHost:   16,
+}
+
 func (c *GcsStorage) httpClient() (*http.Client, error) {
-	return c.jwtConfig.Client(oauth2.NoContext), nil
+	// used by oauth2 both for fetching tokens and as the base transport
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{
+		Transport: gcsTransport,
+	})
+	return c.jwtConfig.Client(ctx), nil
 }
 
-func (c *GcsStorage) url(bucket, key, logName string) string {
+func (c *GcsStorage) url(ctx context.Context, bucket, key, logName string) string {
 	// return "http://127.0.0.1:5656"
 	url := baseURL + bucket + "/" + key
-	log.Print(logName + " " + url)
+	loggerFrom(ctx).Infof("%s %s", logName, url)
 	return url
 }
 
+// maxErrorBodySize caps how much of an error response we read
+const maxErrorBodySize = 64 * 1024
+
+// gcsError builds a StorageError out of an unsuccessful response, which GCS
+// describes in an XML body like:
+//   <Error><Code>AccessDenied</Code><Message>Access denied.</Message></Error>
+func gcsError(res *http.Response, url string) *StorageError {
+	se := newStorageError(res.StatusCode, res.Status, url)
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxErrorBodySize))
+	if err != nil || len(body) == 0 {
+		return se
+	}
+
+	var xmlError struct {
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(body, &xmlError) == nil {
+		se.Code = xmlError.Code
+		se.Message = xmlError.Message
+	}
+
+	return se
+}
+
+// CheckCredentials makes sure we can get an access token with our credentials
+func (c *GcsStorage) CheckCredentials(ctx context.Context) error {
+	_, err := c.jwtConfig.TokenSource(ctx).Token()
+	return err
+}
+
 // GetFile returns a reader for the contents of resource at bucket/key
-func (c *GcsStorage) GetFile(bucket, key string) (io.ReadCloser, error) {
+func (c *GcsStorage) GetFile(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
 	httpClient, err := c.httpClient()
 
 	if err != nil {
 		return nil, err
 	}
 
-	url := c.url(bucket, key, "GET")
+	url := c.url(ctx, bucket, key, "GET")
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 
-	res, err := httpClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := httpClient.Do(req)
 
 	if err != nil {
 		return nil, err
 	}
 
 	if res.StatusCode != 200 {
-		return nil, errors.New(res.Status + " " + url)
+		defer res.Body.Close()
+		return nil, gcsError(res, url)
 	}
 
 	return res.Body, nil
 }
 
+// GetFileRange returns a reader for part of bucket/key, along with its size
+func (c *GcsStorage) GetFileRange(ctx context.Context, bucket, key string, offset, length int64) (io.ReadCloser, int64, error) {
+	httpClient, err := c.httpClient()
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	url := c.url(ctx, bucket, key, "GET")
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req.Header.Set("Range", rangeHeader(offset, length))
+	res, err := httpClient.Do(req)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if res.StatusCode != 200 && res.StatusCode != 206 {
+		defer res.Body.Close()
+		return nil, 0, gcsError(res, url)
+	}
+
+	reader, size, err := rangeOfBody(res, offset, length)
+	if err != nil {
+		res.Body.Close()
+		return nil, 0, err
+	}
+
+	return reader, size, nil
+}
+
 // PutFile uploads a file to GCS simply
-func (c *GcsStorage) PutFile(bucket, key string, contents io.Reader, mimeType string) error {
-	return c.PutFileWithSetup(bucket, key, contents, func(req *http.Request) error {
+func (c *GcsStorage) PutFile(ctx context.Context, bucket, key string, contents io.Reader, mimeType string) error {
+	return c.PutFileWithSetup(ctx, bucket, key, contents, func(req *http.Request) error {
 		req.Header.Add("Content-Type", mimeType)
 		req.Header.Add("x-goog-acl", "public-read")
 		return nil
@@ -93,14 +189,14 @@ func (c *GcsStorage) PutFile(bucket, key string, contents io.Reader, mimeType st
 }
 
 // PutFileWithSetup uploads a file to GCS letting the user set up the request first
-func (c *GcsStorage) PutFileWithSetup(bucket, key string, contents io.Reader, setup StorageSetupFunc) error {
+func (c *GcsStorage) PutFileWithSetup(ctx context.Context, bucket, key string, contents io.Reader, setup StorageSetupFunc) error {
 	httpClient, err := c.httpClient()
 
 	if err != nil {
 		return err
 	}
 
-	req, err := http.NewRequest("PUT", c.url(bucket, key, "PUT"), contents)
+	req, err := http.NewRequestWithContext(ctx, "PUT", c.url(ctx, bucket, key, "PUT"), contents)
 
 	if err != nil {
 		return err
@@ -119,19 +215,87 @@ func (c *GcsStorage) PutFileWithSetup(bucket, key string, contents io.Reader, se
 	}
 
 	defer res.Body.Close()
+
+	if res.StatusCode != 200 && res.StatusCode != 201 {
+		return gcsError(res, req.URL.String())
+	}
+
 	return nil
 }
 
+// ListFiles lists objects of a GCS bucket by prefix, a page at a time
+func (c *GcsStorage) ListFiles(ctx context.Context, bucket, prefix string) ([]StorageObject, error) {
+	httpClient, err := c.httpClient()
+
+	if err != nil {
+		return nil, err
+	}
+
+	objects := []StorageObject{}
+	marker := ""
+
+	for {
+		query := url.Values{}
+		query.Set("prefix", prefix)
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+
+		listURL := baseURL + bucket + "?" + query.Encode()
+		loggerFrom(ctx).Infof("LIST %s", listURL)
+		req, err := http.NewRequestWithContext(ctx, "GET", listURL, nil)
+
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := httpClient.Do(req)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if res.StatusCode != 200 {
+			defer res.Body.Close()
+			return nil, gcsError(res, listURL)
+		}
+
+		var result struct {
+			IsTruncated bool
+			NextMarker  string
+			Contents    []struct {
+				Key  string
+				Size uint64
+			}
+		}
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, content := range result.Contents {
+			objects = append(objects, StorageObject{content.Key, content.Size})
+		}
+
+		if !result.IsTruncated || result.NextMarker == "" {
+			return objects, nil
+		}
+		marker = result.NextMarker
+	}
+}
+
 // DeleteFile removes a file from a GCS bucket
-func (c *GcsStorage) DeleteFile(bucket, key string) error {
+func (c *GcsStorage) DeleteFile(ctx context.Context, bucket, key string) error {
 	httpClient, err := c.httpClient()
 
 	if err != nil {
 		return err
 	}
 
-	url := c.url(bucket, key, "DELETE")
-	req, err := http.NewRequest("DELETE", url, nil)
+	url := c.url(ctx, bucket, key, "DELETE")
+	req, err := http.NewRequestWithContext(ctx, "DELETE", url, nil)
 
 	if err != nil {
 		return err
@@ -143,8 +307,10 @@ func (c *GcsStorage) DeleteFile(bucket, key string) error {
 		return err
 	}
 
+	defer res.Body.Close()
+
 	if res.StatusCode != 200 && res.StatusCode != 204 {
-		return errors.New(res.Status + " " + url)
+		return gcsError(res, url)
 	}
 
 	return nil
@@ -1,10 +1,21 @@
 package zipserver
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2/jwt"
 )
 
 const testPrivateKey = "/home/leafo/code/go/cf45ea3f8a5f730a4b9702d11236439d9b014b20-privatekey.pem"
@@ -35,7 +46,7 @@ func withGoogleCloudStorage(t *testing.T, cb ClientFunc) {
 
 func TestGetFile(t *testing.T) {
 	withGoogleCloudStorage(t, func(storage Storage, config *Config) {
-		reader, err := storage.GetFile(config.Bucket, "text.txt")
+		reader, err := storage.GetFile(context.Background(), config.Bucket, "text.txt")
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -56,16 +67,129 @@ func TestGetFile(t *testing.T) {
 
 func TestPutAndDeleteFile(t *testing.T) {
 	withGoogleCloudStorage(t, func(storage Storage, config *Config) {
-		err := storage.PutFile(config.Bucket, "zipserver_test.txt", strings.NewReader("hello zipserver!"), "text/plain")
+		err := storage.PutFile(context.Background(), config.Bucket, "zipserver_test.txt", strings.NewReader("hello zipserver!"), "text/plain")
 
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		err = storage.DeleteFile(config.Bucket, "zipserver_test.txt")
+		err = storage.DeleteFile(context.Background(), config.Bucket, "zipserver_test.txt")
 
 		if err != nil {
 			t.Fatal(err)
 		}
 	})
 }
+
+// withFakeGcs points a GcsStorage at a local server, which also hands out
+// access tokens
+func withFakeGcs(t *testing.T, handler http.HandlerFunc, cb func(storage *GcsStorage)) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemBytes := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"access_token":"fake","token_type":"Bearer","expires_in":3600}`))
+			return
+		}
+		handler(w, r)
+	}))
+	defer ts.Close()
+
+	previousBaseURL := baseURL
+	baseURL = ts.URL + "/"
+	defer func() { baseURL = previousBaseURL }()
+
+	cb(&GcsStorage{
+		jwtConfig: &jwt.Config{
+			Email:      "zipserver@example.org",
+			PrivateKey: pemBytes,
+			TokenURL:   ts.URL + "/token",
+		},
+	})
+}
+
+func TestGcsErrors(t *testing.T) {
+	ctx := context.Background()
+
+	withFakeGcs(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "PUT":
+			w.WriteHeader(403)
+			w.Write([]byte(`<?xml version='1.0' encoding='UTF-8'?><Error><Code>AccessDenied</Code><Message>Access denied.</Message></Error>`))
+		case "GET":
+			w.WriteHeader(404)
+			w.Write([]byte(`<?xml version='1.0' encoding='UTF-8'?><Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`))
+		default:
+			w.WriteHeader(503)
+		}
+	}, func(storage *GcsStorage) {
+		err := storage.PutFile(ctx, "bucket", "key", strings.NewReader("hello"), "text/plain")
+		var se *StorageError
+		if assert.True(t, errors.As(err, &se), "a rejected upload must be an error") {
+			assert.EqualValues(t, StoragePermissionDenied, se.Kind)
+			assert.EqualValues(t, 403, se.StatusCode)
+			assert.EqualValues(t, "AccessDenied", se.Code)
+			assert.EqualValues(t, "Access denied.", se.Message)
+		}
+
+		_, err = storage.GetFile(ctx, "bucket", "key")
+		if assert.True(t, errors.As(err, &se)) {
+			assert.EqualValues(t, StorageNotFound, se.Kind)
+			assert.EqualValues(t, "NoSuchKey", se.Code)
+		}
+
+		err = storage.DeleteFile(ctx, "bucket", "key")
+		if assert.True(t, errors.As(err, &se)) {
+			assert.EqualValues(t, StorageTransient, se.Kind)
+			assert.EqualValues(t, "", se.Code, "no body, no code")
+		}
+	})
+
+	withFakeGcs(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}, func(storage *GcsStorage) {
+		err := storage.PutFile(ctx, "bucket", "key", strings.NewReader("hello"), "text/plain")
+		assert.NoError(t, err)
+	})
+}
+
+func Test_GcsListFiles(t *testing.T) {
+	ctx := context.Background()
+
+	withFakeGcs(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.EqualValues(t, "/bucket", r.URL.Path)
+		assert.EqualValues(t, "games/", r.URL.Query().Get("prefix"))
+
+		switch r.URL.Query().Get("marker") {
+		case "":
+			w.Write([]byte(`<?xml version='1.0' encoding='UTF-8'?><ListBucketResult>
+				<Name>bucket</Name><Prefix>games/</Prefix><IsTruncated>true</IsTruncated><NextMarker>games/b.txt</NextMarker>
+				<Contents><Key>games/a.txt</Key><Size>1</Size></Contents>
+				<Contents><Key>games/b.txt</Key><Size>22</Size></Contents>
+			</ListBucketResult>`))
+		case "games/b.txt":
+			w.Write([]byte(`<?xml version='1.0' encoding='UTF-8'?><ListBucketResult>
+				<Name>bucket</Name><Prefix>games/</Prefix><IsTruncated>false</IsTruncated>
+				<Contents><Key>games/c.txt</Key><Size>333</Size></Contents>
+			</ListBucketResult>`))
+		default:
+			w.WriteHeader(400)
+		}
+	}, func(storage *GcsStorage) {
+		objects, err := storage.ListFiles(ctx, "bucket", "games/")
+		assert.NoError(t, err)
+		assert.EqualValues(t, []StorageObject{
+			{"games/a.txt", 1},
+			{"games/b.txt", 22},
+			{"games/c.txt", 333},
+		}, objects)
+	})
+}
@@ -0,0 +1,143 @@
+package zipserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// storageCheckInterval is how long the result of a storage credentials
+// check is reused, probes come in much more often than that
+const storageCheckInterval = 30 * time.Second
+
+var errDiskFreeUnsupported = errors.New("free space check not supported on this platform")
+
+// checkStorage makes sure the storage backend is usable, it's a variable so
+// tests can swap it
+var checkStorage = func(ctx context.Context, config *Config) error {
+	storage, err := NewGcsStorage(config)
+	if err != nil {
+		return err
+	}
+
+	return storage.CheckCredentials(ctx)
+}
+
+var storageCheck struct {
+	sync.Mutex
+	checkedAt time.Time
+	err       error
+}
+
+// cachedStorageCheck runs checkStorage at most once per storageCheckInterval
+func cachedStorageCheck(ctx context.Context, config *Config) error {
+	storageCheck.Lock()
+	defer storageCheck.Unlock()
+
+	if time.Since(storageCheck.checkedAt) > storageCheckInterval {
+		storageCheck.err = checkStorage(ctx, config)
+		storageCheck.checkedAt = time.Now()
+	}
+
+	return storageCheck.err
+}
+
+// checkTmpDir makes sure we can write to the temporary directory and that
+// there's enough room left in it to download zips
+func checkTmpDir(config *Config) error {
+	err := os.MkdirAll(tmpDir, os.ModeDir|0777)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(tmpDir, "readyz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write([]byte("ok"))
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	free, err := diskFree(tmpDir)
+	if err == errDiskFreeUnsupported {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if free < config.MinTmpFreeSpace {
+		return fmt.Errorf("Only %d bytes free in %s (need %d)", free, tmpDir, config.MinTmpFreeSpace)
+	}
+
+	return nil
+}
+
+// checkJobs makes sure we're taking new work and aren't already swamped
+func checkJobs(config *Config) error {
+	inFlight, draining := workStatus()
+	if draining {
+		return errShuttingDown
+	}
+
+	if config.MaxInFlightJobs > 0 && inFlight >= config.MaxInFlightJobs {
+		return fmt.Errorf("Too many jobs in flight (%d >= %d)", inFlight, config.MaxInFlightJobs)
+	}
+
+	return nil
+}
+
+// healthzHandler tells whether the process is alive, that's all
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSONMessage(w, struct{ Alive bool }{true})
+}
+
+// readyzHandler tells whether we're able to take work: responds with 200 if
+// all checks pass, 503 otherwise, and the result of each check either way
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{}
+	ready := true
+
+	record := func(name string, err error) {
+		if err != nil {
+			checks[name] = err.Error()
+			ready = false
+		} else {
+			checks[name] = "ok"
+		}
+	}
+
+	if config == nil {
+		record("config", errors.New("Config not loaded"))
+	} else {
+		record("config", nil)
+
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+
+		record("tmpdir", checkTmpDir(config))
+		record("storage", cachedStorageCheck(ctx, config))
+		record("jobs", checkJobs(config))
+	}
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	writeJSONMessageWithStatus(w, status, struct {
+		Ready  bool
+		Checks map[string]string
+	}{ready, checks})
+}
@@ -0,0 +1,87 @@
+package zipserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Healthz(t *testing.T) {
+	rec := httptest.NewRecorder()
+	healthzHandler(rec, httptest.NewRequest("GET", "/healthz", nil))
+	assert.EqualValues(t, 200, rec.Code)
+	assert.JSONEq(t, `{"Alive":true}`, rec.Body.String())
+}
+
+func Test_Readyz(t *testing.T) {
+	previousConfig := config
+	previousCheck := checkStorage
+	defer func() {
+		config = previousConfig
+		checkStorage = previousCheck
+	}()
+
+	var storageErr error
+	checkStorage = func(ctx context.Context, config *Config) error {
+		return storageErr
+	}
+
+	readyz := func() (int, map[string]string) {
+		// forget the previous storage check
+		storageCheck.checkedAt = time.Time{}
+
+		rec := httptest.NewRecorder()
+		readyzHandler(rec, httptest.NewRequest("GET", "/readyz", nil))
+
+		var res struct {
+			Ready  bool
+			Checks map[string]string
+		}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+		assert.EqualValues(t, rec.Code == 200, res.Ready)
+		return rec.Code, res.Checks
+	}
+
+	config = nil
+	code, checks := readyz()
+	assert.EqualValues(t, 503, code)
+	assert.EqualValues(t, "Config not loaded", checks["config"])
+
+	config = emptyConfig()
+	code, checks = readyz()
+	assert.EqualValues(t, 200, code)
+	assert.EqualValues(t, map[string]string{
+		"config":  "ok",
+		"tmpdir":  "ok",
+		"storage": "ok",
+		"jobs":    "ok",
+	}, checks)
+
+	storageErr = errors.New("invalid_grant")
+	code, checks = readyz()
+	assert.EqualValues(t, 503, code)
+	assert.EqualValues(t, "invalid_grant", checks["storage"])
+	storageErr = nil
+
+	config.MinTmpFreeSpace = 1 << 62
+	code, checks = readyz()
+	assert.EqualValues(t, 503, code)
+	assert.Contains(t, checks["tmpdir"], "bytes free")
+	config.MinTmpFreeSpace = 0
+
+	config.MaxInFlightJobs = 1
+	_, done, err := beginWork()
+	assert.NoError(t, err)
+	code, checks = readyz()
+	assert.EqualValues(t, 503, code)
+	assert.Contains(t, checks["jobs"], "Too many jobs in flight")
+
+	done()
+	code, _ = readyz()
+	assert.EqualValues(t, 200, code)
+}
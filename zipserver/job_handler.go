@@ -0,0 +1,117 @@
+package zipserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+// jobError reports a job failure as a kind other than the job's own, eg. an
+// ExtractError for a slurp and extract that got past the download
+type jobError struct {
+	kind string
+	err  error
+}
+
+func (e *jobError) Error() string { return e.err.Error() }
+
+func (e *jobError) Unwrap() error { return e.err }
+
+// jobErrorKind is the kind err is reported as, for a job of the given kind
+func jobErrorKind(kind string, err error) string {
+	var jobErr *jobError
+	if errors.As(err, &jobErr) {
+		return jobErr.kind
+	}
+	return kind
+}
+
+// runJob runs work as its own job, which can be canceled by its ID. Without
+// a callback URL, the client waits, and gets the fields of the result in
+// the response. Otherwise it's told the job ID right away, and the result
+// is posted to the callback, described by encode.
+//
+// work may return a partial result along with an error, to tell the client
+// how far it got. Failures are reported as kind, unless wrapped in a
+// jobError.
+func runJob(w http.ResponseWriter, r *http.Request, callbackURL string, kind string,
+	work func(ctx context.Context) (interface{}, error),
+	encode func(values url.Values, result interface{})) error {
+
+	ctx, done, err := beginWork()
+	if err != nil {
+		return writeJSONError(w, kind, err)
+	}
+
+	jobID := newID()
+	ctx = jobContext(ctx, r, jobID)
+
+	ctx, abort := withAbort(ctx)
+	unregister := registerCancelable(jobID, abort)
+
+	if callbackURL == "" {
+		defer done()
+		defer abort(nil)
+		defer unregister()
+		defer abortOnDisconnect(r, abort)()
+
+		result, err := work(ctx)
+		if err != nil {
+			msg := newErrorMessage(jobErrorKind(kind, err), err)
+			if result == nil {
+				return writeJSONMessageWithStatus(w, statusCodeFor(err), msg)
+			}
+			return writeJSONFields(w, statusCodeFor(err), msg, result)
+		}
+
+		return writeJSONFields(w, http.StatusOK, struct {
+			Success bool
+			JobID   string
+		}{true, jobID}, result)
+	}
+
+	go (func() {
+		defer done()
+		defer abort(nil)
+		defer unregister()
+
+		result, err := work(ctx)
+
+		resValues := url.Values{}
+		resValues.Add("JobID", jobID)
+		if err != nil {
+			addErrorValues(resValues, jobErrorKind(kind, err), err)
+		} else {
+			resValues.Add("Success", "true")
+		}
+		if result != nil {
+			encode(resValues, result)
+		}
+
+		notifyCallback(ctx, jobCallback{url: callbackURL, requestID: requestIDFrom(r.Context())}, resValues)
+	})()
+
+	return writeJSONMessage(w, struct {
+		Processing bool
+		Async      bool
+		JobID      string
+	}{true, true, jobID})
+}
+
+// writeJSONFields responds with a single JSON object holding the fields of
+// every message, the way embedding them in a struct would
+func writeJSONFields(w http.ResponseWriter, status int, msgs ...interface{}) error {
+	fields := map[string]json.RawMessage{}
+	for _, msg := range msgs {
+		blob, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(blob, &fields); err != nil {
+			return err
+		}
+	}
+	return writeJSONMessageWithStatus(w, status, fields)
+}
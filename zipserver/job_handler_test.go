@@ -0,0 +1,75 @@
+package zipserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_RunJob(t *testing.T) {
+	type result struct {
+		Size int
+	}
+
+	succeed := func(ctx context.Context) (interface{}, error) {
+		return &result{Size: 3}, nil
+	}
+	failPartway := func(ctx context.Context) (interface{}, error) {
+		return &result{Size: 1}, &jobError{"LaterError", errors.New("boom")}
+	}
+	encode := func(values url.Values, res interface{}) {
+		values.Add("Size", "size")
+	}
+
+	run := func(work func(ctx context.Context) (interface{}, error), callbackURL string) (int, map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/job", nil)
+		assert.NoError(t, runJob(rec, req, callbackURL, "TestError", work, encode))
+
+		var body map[string]interface{}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		return rec.Code, body
+	}
+
+	// the result's fields are part of the response
+	code, body := run(succeed, "")
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.EqualValues(t, true, body["Success"])
+	assert.NotEmpty(t, body["JobID"])
+	assert.EqualValues(t, 3, body["Size"])
+
+	// so is a partial result, when the job fails
+	code, body = run(failPartway, "")
+	assert.EqualValues(t, http.StatusInternalServerError, code)
+	assert.EqualValues(t, "LaterError", body["Type"])
+	assert.EqualValues(t, "boom", body["Error"])
+	assert.EqualValues(t, 1, body["Size"])
+
+	callbacks := make(chan url.Values, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		callbacks <- r.PostForm
+	}))
+	defer ts.Close()
+
+	code, body = run(succeed, ts.URL)
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.EqualValues(t, true, body["Async"])
+
+	values := <-callbacks
+	assert.EqualValues(t, body["JobID"], values.Get("JobID"))
+	assert.EqualValues(t, "true", values.Get("Success"))
+	assert.EqualValues(t, "size", values.Get("Size"))
+
+	run(failPartway, ts.URL)
+	values = <-callbacks
+	assert.EqualValues(t, "LaterError", values.Get("Type"))
+	assert.EqualValues(t, "", values.Get("Success"))
+	assert.EqualValues(t, "size", values.Get("Size"))
+}
@@ -3,9 +3,15 @@ package zipserver
 import (
 	"archive/zip"
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"time"
 )
 
 type fileTuple struct {
@@ -13,73 +19,307 @@ type fileTuple struct {
 	Size     uint64
 }
 
-func listZip(body []byte, w http.ResponseWriter, r *http.Request) error {
-	zipFile, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+// ZipEntry describes a file in a zip, as listed with details
+type ZipEntry struct {
+	Filename       string
+	Size           uint64
+	CompressedSize uint64
+	// store, deflate, or the method number if we don't support it
+	Method   string
+	CRC32    uint32
+	Modified time.Time
+	// external attributes as set by the zip tool, and the file mode
+	// they describe
+	ExternalAttrs uint32
+	Mode          string
+	Comment       string `json:",omitempty"`
+	Encrypted     bool
+	// whether extraction skips it
+	Ignored bool
+
+	// what extracting to the requested prefix would do with it
+	Key             string `json:",omitempty"`
+	ContentType     string `json:",omitempty"`
+	ContentEncoding string `json:",omitempty"`
+	// why the content couldn't be looked at, if so
+	Error string `json:",omitempty"`
+}
+
+// zipEntryFor describes file, detecting its MIME type and encoding the way
+// extracting it to prefix would (which requires reading its first bytes)
+func zipEntryFor(file *zip.File, prefix string) ZipEntry {
+	entry := ZipEntry{
+		Filename:       file.Name,
+		Size:           file.UncompressedSize64,
+		CompressedSize: file.CompressedSize64,
+		Method:         methodName(file.Method),
+		CRC32:          file.CRC32,
+		Modified:       file.Modified,
+		ExternalAttrs:  file.ExternalAttrs,
+		Mode:           file.Mode().String(),
+		Comment:        file.Comment,
+		// bit 0 of the general purpose flags
+		Encrypted: file.Flags&0x1 != 0,
+		Ignored:   shouldIgnoreFile(file.Name),
+	}
+
+	if entry.Ignored {
+		return entry
+	}
+
+	key := file.Name
+	if prefix != "" {
+		key = path.Join(config.ExtractPrefix, prefix, file.Name)
+	}
+
+	head, err := sniffZipEntry(file)
+	if err != nil {
+		entry.Error = err.Error()
+		return entry
+	}
+
+	resource := newResourceSpec(key, head)
+	if prefix != "" {
+		entry.Key = resource.key
+	}
+	entry.ContentType = resource.contentType
+	entry.ContentEncoding = resource.contentEncoding
+	return entry
+}
+
+// maxDetailedEntries caps how many entries are listed with details at once,
+// since each of them has to be read
+const maxDetailedEntries = 1000
+
+// zipOrder returns the indices of page, a selection of files of a zip, in
+// the order they're stored in the zip. Reading them that way goes through
+// the zip from start to end, rather than fetching a range for each of them.
+func zipOrder(files []*zip.File, page []*zip.File) []int {
+	positions := make(map[*zip.File]int, len(files))
+	for i, file := range files {
+		positions[file] = i
+	}
+
+	order := make([]int, len(page))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return positions[page[order[i]]] < positions[page[order[j]]]
+	})
+	return order
+}
+
+// sniffZipEntry reads the first bytes of a file in a zip
+func sniffZipEntry(file *zip.File) ([]byte, error) {
+	reader, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(io.LimitReader(reader, sniffLen))
+}
+
+func methodName(method uint16) string {
+	switch method {
+	case zip.Store:
+		return "store"
+	case zip.Deflate:
+		return "deflate"
+	default:
+		return strconv.Itoa(int(method))
+	}
+}
+
+func listZip(readerAt io.ReaderAt, size int64, req *ListRequest, w http.ResponseWriter) error {
+	zipFile, err := zip.NewReader(readerAt, size)
 
 	if err != nil {
 		return err
 	}
 
+	files := selectFiles(zipFile.File, req)
+
+	switch req.Format {
+	case listFormatTree:
+		return writeJSONMessage(w, buildTree(files))
+	case listFormatDirectories:
+		dirs := aggregateDirectories(files, req)
+		start, end, next := req.paginate(len(dirs))
+		return writeListing(w, req, dirs[start:end], len(dirs), next)
+	}
+
+	start, end, next := req.paginate(len(files))
+	page := files[start:end]
+
+	if req.Details {
+		if len(page) > maxDetailedEntries {
+			return badRequest("Can't list more than %d entries with details, use limit to paginate", maxDetailedEntries)
+		}
+
+		entries := make([]ZipEntry, len(page))
+		for _, i := range zipOrder(zipFile.File, page) {
+			entries[i] = zipEntryFor(page[i], req.Prefix)
+		}
+		return writeListing(w, req, entries, len(files), next)
+	}
+
 	var filesOut []fileTuple
 
-	for _, file := range zipFile.File {
+	for _, file := range page {
 		filesOut = append(filesOut, fileTuple{
 			file.Name, file.UncompressedSize64,
 		})
 	}
 
-	return writeJSONMessage(w, filesOut)
+	return writeListing(w, req, filesOut, len(files), next)
 }
 
-func listFromBucket(key string, w http.ResponseWriter, r *http.Request) error {
-	storage, err := NewGcsStorage(config)
+// writeListing writes entries as is, or as a ListPage if req is paginated
+func writeListing(w http.ResponseWriter, req *ListRequest, entries interface{}, total int, next string) error {
+	if !req.paginated() {
+		return writeJSONMessage(w, entries)
+	}
 
-	if storage == nil {
+	return writeJSONMessage(w, ListPage{
+		Entries:    entries,
+		Total:      total,
+		NextCursor: next,
+	})
+}
+
+// listRanged lists a zip by reading only its central directory, and the
+// first bytes of each file for details
+func listRanged(ctx context.Context, fetch rangeFetcher, req *ListRequest, w http.ResponseWriter) error {
+	readerAt, err := newRangedReaderAt(ctx, fetch)
+	if err != nil {
 		return err
 	}
 
-	reader, err := storage.GetFile(config.Bucket, key)
-	defer reader.Close()
+	defer func() {
+		metrics.downloadedBytes.WithLabelValues("list").Add(float64(readerAt.bytesFetched()))
+	}()
 
-	if err != nil {
+	return listZip(readerAt, readerAt.size, req, w)
+}
+
+func listFromBucket(key string, req *ListRequest, w http.ResponseWriter, r *http.Request) error {
+	storage, err := newStorage(config)
+
+	if storage == nil {
 		return err
 	}
 
-	body, err := io.ReadAll(reader)
+	return listRanged(r.Context(), func(ctx context.Context, offset, length int64) (io.ReadCloser, int64, error) {
+		return storage.GetFileRange(ctx, config.Bucket, key, offset, length)
+	}, req, w)
+}
 
-	if err != nil {
+// errRangesUnsupported is returned when a server answers a range request with
+// the whole file
+var errRangesUnsupported = errors.New("Range requests not supported")
+
+// urlRangeFetcher reads parts of url with range requests
+func urlRangeFetcher(url string) rangeFetcher {
+	return func(ctx context.Context, offset, length int64) (io.ReadCloser, int64, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		req.Header.Set("Range", rangeHeader(offset, length))
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if res.StatusCode == http.StatusOK {
+			res.Body.Close()
+			return nil, 0, errRangesUnsupported
+		}
+
+		if res.StatusCode != http.StatusPartialContent {
+			res.Body.Close()
+			return nil, 0, fmt.Errorf("Failed to fetch file: %d", res.StatusCode)
+		}
+
+		size, _, err := rangeSize(res)
+		if err != nil {
+			res.Body.Close()
+			return nil, 0, err
+		}
+		return res.Body, size, nil
+	}
+}
+
+func listFromUrl(url string, req *ListRequest, w http.ResponseWriter, r *http.Request) error {
+	err := listRanged(r.Context(), urlRangeFetcher(url), req, w)
+	if !errors.Is(err, errRangesUnsupported) {
 		return err
 	}
 
-	return listZip(body, w, r)
+	loggerFrom(r.Context()).Infof("%s doesn't support range requests, downloading it", url)
+	return listDownloaded(url, req, w, r)
 }
 
-func listFromUrl(url string, w http.ResponseWriter, r *http.Request) error {
-	response, err := http.Get(url)
+// listDownloaded lists a zip downloaded in full, as long as it's no larger
+// than MaxListFallbackSize
+func listDownloaded(url string, req *ListRequest, w http.ResponseWriter, r *http.Request) error {
+	maxBytes := config.MaxListFallbackSize
+
+	request, err := http.NewRequestWithContext(r.Context(), "GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := http.DefaultClient.Do(request)
 	if err != nil {
 		return err
 	}
 
 	defer response.Body.Close()
-	body, err := io.ReadAll(response.Body)
 
-	return listZip(body, w, r)
-}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to fetch file: %d", response.StatusCode)
+	}
 
-func listHandler(w http.ResponseWriter, r *http.Request) error {
-	params := r.URL.Query()
+	tooLarge := limitExceeded("Zip too large to list without range requests (max %d bytes)", maxBytes)
+	if response.ContentLength > int64(maxBytes) {
+		return tooLarge
+	}
 
-	key, err := getParam(params, "key")
+	body, err := io.ReadAll(io.LimitReader(response.Body, int64(maxBytes)+1))
+	metrics.downloadedBytes.WithLabelValues("list").Add(float64(len(body)))
 
-	if err == nil {
-		return listFromBucket(key, w, r)
+	if err != nil {
+		return err
 	}
 
-	url, err := getParam(params, "url")
+	if uint64(len(body)) > maxBytes {
+		return tooLarge
+	}
 
-	if err == nil {
-		return listFromUrl(url, w, r)
+	return listZip(bytes.NewReader(body), int64(len(body)), req, w)
+}
+
+func listHandler(w http.ResponseWriter, r *http.Request) error {
+	req, err := parseListRequest(r)
+	if err != nil {
+		metrics.operations.WithLabelValues("list", outcomeLabel(err)).Inc()
+		return err
 	}
 
-	return errors.New("missing key or url")
+	if req.Key != "" {
+		err = listFromBucket(req.Key, req, w, r)
+	} else {
+		err = listFromUrl(req.URL, req, w, r)
+	}
+	metrics.operations.WithLabelValues("list", outcomeLabel(err)).Inc()
+
+	if err != nil {
+		loggerFrom(r.Context()).Errorf("List failed: %s", err.Error())
+		return writeJSONError(w, "ListError", err)
+	}
+	return nil
 }
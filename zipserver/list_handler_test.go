@@ -0,0 +1,320 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ListDetails(t *testing.T) {
+	previousConfig := config
+	defer func() { config = previousConfig }()
+	config = emptyConfig()
+	config.ExtractPrefix = "games"
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	modified := time.Date(2020, 4, 1, 12, 30, 0, 0, time.UTC)
+	headers := []*zip.FileHeader{
+		{Name: "index.html", Method: zip.Deflate, Modified: modified, Comment: "start here"},
+		{Name: "game.jsgz", Method: zip.Store, Modified: modified},
+		{Name: "__MACOSX/._index.html", Method: zip.Store, Modified: modified},
+	}
+	contents := [][]byte{
+		[]byte("<!doctype html><html><body>hi</body></html>"),
+		[]byte{0x1F, 0x8B, 0x08, 3, 7, 3, 4, 12, 53, 26, 34},
+		[]byte("junk"),
+	}
+
+	for i, header := range headers {
+		header.SetMode(0644)
+		writer, err := zw.CreateHeader(header)
+		assert.NoError(t, err)
+		_, err = writer.Write(contents[i])
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, zw.Close())
+
+	rec := httptest.NewRecorder()
+	assert.NoError(t, listZip(bytes.NewReader(buf.Bytes()), int64(buf.Len()), &ListRequest{Details: true, Prefix: "extracted"}, rec))
+
+	var entries []ZipEntry
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &entries))
+	if !assert.EqualValues(t, 3, len(entries)) {
+		return
+	}
+
+	html := entries[0]
+	assert.EqualValues(t, "index.html", html.Filename)
+	assert.EqualValues(t, len(contents[0]), html.Size)
+	assert.EqualValues(t, "deflate", html.Method)
+	assert.True(t, html.Modified.Equal(modified))
+	assert.EqualValues(t, "-rw-r--r--", html.Mode)
+	assert.EqualValues(t, "start here", html.Comment)
+	assert.False(t, html.Encrypted)
+	assert.False(t, html.Ignored)
+	assert.EqualValues(t, "games/extracted/index.html", html.Key)
+	assert.EqualValues(t, "text/html; charset=utf-8", html.ContentType)
+
+	game := entries[1]
+	assert.EqualValues(t, "store", game.Method)
+	assert.EqualValues(t, game.Size, game.CompressedSize)
+	assert.EqualValues(t, "games/extracted/game.js", game.Key, "rewrite rules apply")
+	assert.EqualValues(t, "gzip", game.ContentEncoding)
+
+	junk := entries[2]
+	assert.True(t, junk.Ignored)
+	assert.EqualValues(t, "", junk.Key)
+
+	// without details, the output stays the same
+	rec = httptest.NewRecorder()
+	assert.NoError(t, listZip(bytes.NewReader(buf.Bytes()), int64(buf.Len()), &ListRequest{}, rec))
+	assert.JSONEq(t, `[
+		{"Filename": "index.html", "Size": 43},
+		{"Filename": "game.jsgz", "Size": 11},
+		{"Filename": "__MACOSX/._index.html", "Size": 4}
+	]`, rec.Body.String())
+}
+
+func Test_ListDetailsReads(t *testing.T) {
+	previousConfig := config
+	defer func() { config = previousConfig }()
+	config = emptyConfig()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	zl := &zipLayout{}
+	for i := 0; i < 40; i++ {
+		zl.entries = append(zl.entries, zipEntry{name: fmt.Sprintf("file%02d.bin", i), data: randomBytes(t, 8*1024+i)})
+	}
+	zl.Write(t, zw)
+	assert.NoError(t, zw.Close())
+	data := buf.Bytes()
+
+	fetches := 0
+	readerAt, err := newRangedReaderAt(context.Background(), func(ctx context.Context, offset, length int64) (io.ReadCloser, int64, error) {
+		fetches++
+		start, end := resolveRange(offset, length, int64(len(data)))
+		return io.NopCloser(bytes.NewReader(data[start:end])), int64(len(data)), nil
+	})
+	assert.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	assert.NoError(t, listZip(readerAt, readerAt.size, &ListRequest{Details: true, Sort: "-name"}, rec))
+
+	var entries []ZipEntry
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &entries))
+	if assert.EqualValues(t, 40, len(entries)) {
+		assert.EqualValues(t, "file39.bin", entries[0].Filename, "still sorted as asked")
+		assert.EqualValues(t, "application/octet-stream", entries[0].ContentType)
+	}
+	assert.True(t, fetches <= 5, "files are read in zip order, not once each (%d fetches)", fetches)
+
+	// too many to list with details at once
+	buf.Reset()
+	zw = zip.NewWriter(&buf)
+	for i := 0; i <= maxDetailedEntries; i++ {
+		_, err := zw.Create(fmt.Sprintf("%d.txt", i))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, zw.Close())
+
+	err = listZip(bytes.NewReader(buf.Bytes()), int64(buf.Len()), &ListRequest{Details: true}, httptest.NewRecorder())
+	assert.EqualValues(t, http.StatusBadRequest, statusCodeFor(err))
+
+	rec = httptest.NewRecorder()
+	assert.NoError(t, listZip(bytes.NewReader(buf.Bytes()), int64(buf.Len()), &ListRequest{Details: true, Limit: 10}, rec), "fine a page at a time")
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	data := make([]byte, n)
+	_, err := rand.New(rand.NewSource(int64(n))).Read(data)
+	assert.NoError(t, err)
+	return data
+}
+
+func Test_ListRanged(t *testing.T) {
+	previousConfig := config
+	defer func() { config = previousConfig }()
+	config = emptyConfig()
+	config.MaxListFallbackSize = 1024 * 1024
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	zl := &zipLayout{
+		entries: []zipEntry{
+			// incompressible, so the zip is much bigger than what's read
+			zipEntry{name: "big.bin", data: randomBytes(t, 4*rangeBlockSize)},
+			zipEntry{name: "small.txt", data: []byte("hi")},
+		},
+	}
+	zl.Write(t, zw)
+	assert.NoError(t, zw.Close())
+	data := buf.Bytes()
+
+	var rangeRequests int32
+	ranged := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			atomic.AddInt32(&rangeRequests, 1)
+		}
+		http.ServeContent(w, r, "file.zip", time.Time{}, bytes.NewReader(data))
+	}))
+	defer ranged.Close()
+
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer plain.Close()
+
+	list := func(url string) (*httptest.ResponseRecorder, error) {
+		rec := httptest.NewRecorder()
+		err := listFromUrl(url, &ListRequest{URL: url}, rec, httptest.NewRequest("GET", "/list", nil))
+		return rec, err
+	}
+
+	expected := `[{"Filename": "big.bin", "Size": 524288}, {"Filename": "small.txt", "Size": 2}]`
+
+	rec, err := list(ranged.URL)
+	assert.NoError(t, err)
+	assert.JSONEq(t, expected, rec.Body.String())
+	assert.EqualValues(t, 1, atomic.LoadInt32(&rangeRequests), "the end of the zip holds the central directory")
+
+	rec, err = list(plain.URL)
+	assert.NoError(t, err, "falls back to downloading it")
+	assert.JSONEq(t, expected, rec.Body.String())
+
+	config.MaxListFallbackSize = 1024
+	_, err = list(plain.URL)
+	assert.Error(t, err)
+	assert.EqualValues(t, http.StatusUnprocessableEntity, statusCodeFor(err))
+
+	_, err = list(ranged.URL)
+	assert.NoError(t, err, "the fallback limit doesn't apply to range requests")
+}
+
+func Test_RangedReaderAt(t *testing.T) {
+	data := randomBytes(t, 3*rangeBlockSize+100)
+	storage, err := NewMemStorage()
+	assert.NoError(t, err)
+	assert.NoError(t, storage.PutFile(context.Background(), "bucket", "data", bytes.NewReader(data), "application/octet-stream"))
+
+	fetches := 0
+	readerAt, err := newRangedReaderAt(context.Background(), func(ctx context.Context, offset, length int64) (io.ReadCloser, int64, error) {
+		fetches++
+		return storage.GetFileRange(ctx, "bucket", "data", offset, length)
+	})
+	assert.NoError(t, err)
+	assert.EqualValues(t, len(data), readerAt.size)
+
+	// the end comes from the first fetch
+	p := make([]byte, 50)
+	n, err := readerAt.ReadAt(p, int64(len(data)-50))
+	assert.NoError(t, err)
+	assert.EqualValues(t, 50, n)
+	assert.EqualValues(t, data[len(data)-50:], p)
+	assert.EqualValues(t, 1, fetches)
+
+	// spanning blocks
+	p = make([]byte, rangeBlockSize+10)
+	n, err = readerAt.ReadAt(p, 10)
+	assert.NoError(t, err)
+	assert.EqualValues(t, len(p), n)
+	assert.EqualValues(t, data[10:10+len(p)], p)
+
+	n, err = readerAt.ReadAt(make([]byte, 200), int64(len(data)-100))
+	assert.EqualValues(t, 100, n)
+	assert.Equal(t, io.EOF, err)
+}
+
+func Test_ListOptions(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	zl := &zipLayout{
+		entries: []zipEntry{
+			zipEntry{name: "index.html", data: []byte("hello")},
+			zipEntry{name: "img/a.png", data: []byte("aaa")},
+			zipEntry{name: "img/icons/b.png", data: []byte("bb")},
+			zipEntry{name: "js/game.js", data: []byte("gamegamegame")},
+		},
+	}
+	zl.Write(t, zw)
+	assert.NoError(t, zw.Close())
+
+	list := func(query string) string {
+		req, err := parseListRequest(httptest.NewRequest("GET", "/list?key=file.zip&"+query, nil))
+		if !assert.NoError(t, err, query) {
+			return ""
+		}
+
+		rec := httptest.NewRecorder()
+		assert.NoError(t, listZip(bytes.NewReader(buf.Bytes()), int64(buf.Len()), req, rec))
+		return rec.Body.String()
+	}
+
+	assert.JSONEq(t, `[
+		{"Filename": "img/a.png", "Size": 3},
+		{"Filename": "img/icons/b.png", "Size": 2}
+	]`, list("glob=*.png"))
+
+	assert.JSONEq(t, `[{"Filename": "img/a.png", "Size": 3}]`, list("glob=img/*.png"))
+	assert.JSONEq(t, `[{"Filename": "js/game.js", "Size": 12}]`, list("pathPrefix=js/"))
+
+	assert.JSONEq(t, `[
+		{"Filename": "js/game.js", "Size": 12},
+		{"Filename": "index.html", "Size": 5},
+		{"Filename": "img/a.png", "Size": 3},
+		{"Filename": "img/icons/b.png", "Size": 2}
+	]`, list("sort=-size"))
+
+	var page ListPage
+	assert.NoError(t, json.Unmarshal([]byte(list("sort=name&limit=3")), &page))
+	assert.EqualValues(t, 4, page.Total)
+	assert.EqualValues(t, 3, len(page.Entries.([]interface{})))
+	assert.NotEmpty(t, page.NextCursor)
+
+	assert.JSONEq(t, `{
+		"Entries": [{"Filename": "js/game.js", "Size": 12}],
+		"Total": 4
+	}`, list("sort=name&limit=3&cursor="+page.NextCursor))
+
+	assert.JSONEq(t, `[
+		{"Path": "", "Files": 4, "Size": 22},
+		{"Path": "img", "Files": 2, "Size": 5},
+		{"Path": "img/icons", "Files": 1, "Size": 2},
+		{"Path": "js", "Files": 1, "Size": 12}
+	]`, list("format=directories"))
+
+	assert.JSONEq(t, `{
+		"Name": "", "Directory": true, "Files": 4, "Size": 22,
+		"Children": [
+			{"Name": "index.html", "Size": 5},
+			{"Name": "img", "Directory": true, "Files": 2, "Size": 5, "Children": [
+				{"Name": "a.png", "Size": 3},
+				{"Name": "icons", "Directory": true, "Files": 1, "Size": 2, "Children": [
+					{"Name": "b.png", "Size": 2}
+				]}
+			]},
+			{"Name": "js", "Directory": true, "Files": 1, "Size": 12, "Children": [
+				{"Name": "game.js", "Size": 12}
+			]}
+		]
+	}`, list("format=tree"))
+
+	for _, query := range []string{"format=tree&limit=2", "format=table", "glob=[", "sort=color", "limit=-1", "cursor=nope"} {
+		_, err := parseListRequest(httptest.NewRequest("GET", "/list?key=file.zip&"+query, nil))
+		assert.Error(t, err, query)
+		assert.EqualValues(t, http.StatusBadRequest, statusCodeFor(err), query)
+	}
+}
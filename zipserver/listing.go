@@ -0,0 +1,269 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"encoding/base64"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Listing formats
+const (
+	listFormatFiles       = "files"
+	listFormatDirectories = "directories"
+	listFormatTree        = "tree"
+)
+
+// ListPage is what /list returns when paginated
+type ListPage struct {
+	Entries interface{}
+	// entries matching across all pages
+	Total int
+	// to pass as the cursor of the next request, empty on the last page
+	NextCursor string `json:",omitempty"`
+}
+
+// ListDirectory sums up what's under a directory of a zip, recursively
+type ListDirectory struct {
+	Path  string
+	Files int
+	Size  uint64
+}
+
+// ListTreeNode is a file or a directory of a zip, listed as a tree. Directories
+// count the files under them and their total size.
+type ListTreeNode struct {
+	Name      string
+	Directory bool `json:",omitempty"`
+	Files     int  `json:",omitempty"`
+	Size      uint64
+	Children  []*ListTreeNode `json:",omitempty"`
+}
+
+// validate checks the listing options of req
+func (req *ListRequest) validate() error {
+	switch req.Format {
+	case "", listFormatFiles, listFormatDirectories:
+	case listFormatTree:
+		if req.Limit != 0 || req.Cursor != "" {
+			return badRequest("Trees can't be paginated")
+		}
+	default:
+		return badRequest("Invalid format: %s", req.Format)
+	}
+
+	if req.Glob != "" {
+		if _, err := path.Match(req.Glob, ""); err != nil {
+			return badRequest("Invalid glob: %s", req.Glob)
+		}
+	}
+
+	switch strings.TrimPrefix(req.Sort, "-") {
+	case "", "name", "size", "modified":
+	default:
+		return badRequest("Invalid sort: %s", req.Sort)
+	}
+
+	if req.Limit < 0 {
+		return badRequest("Invalid limit: %d", req.Limit)
+	}
+
+	if _, err := decodeCursor(req.Cursor); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// matches tells whether a file is selected by the filters of req. Globs
+// without a slash match base names, like in .gitignore
+func (req *ListRequest) matches(name string) bool {
+	if !strings.HasPrefix(name, req.PathPrefix) {
+		return false
+	}
+
+	if req.Glob == "" {
+		return true
+	}
+
+	subject := name
+	if !strings.Contains(req.Glob, "/") {
+		subject = path.Base(name)
+	}
+	matched, _ := path.Match(req.Glob, subject)
+	return matched
+}
+
+// paginated tells whether the listing should be a ListPage
+func (req *ListRequest) paginated() bool {
+	return req.Limit > 0 || req.Cursor != ""
+}
+
+func encodeCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, badRequest("Invalid cursor")
+	}
+
+	offset, err := strconv.Atoi(string(decoded))
+	if err != nil || offset < 0 {
+		return 0, badRequest("Invalid cursor")
+	}
+	return offset, nil
+}
+
+// paginate returns the bounds of the page req asks for out of total entries,
+// and the cursor of the next one
+func (req *ListRequest) paginate(total int) (int, int, string) {
+	start, _ := decodeCursor(req.Cursor)
+	if start > total {
+		start = total
+	}
+
+	end := total
+	if req.Limit > 0 && start+req.Limit < total {
+		end = start + req.Limit
+	}
+
+	next := ""
+	if end < total {
+		next = encodeCursor(end)
+	}
+	return start, end, next
+}
+
+// selectFiles returns the files of a zip req lists, in order. Entries for
+// directories are left out.
+func selectFiles(files []*zip.File, req *ListRequest) []*zip.File {
+	selected := []*zip.File{}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name, "/") || !req.matches(file.Name) {
+			continue
+		}
+		selected = append(selected, file)
+	}
+
+	descending := strings.HasPrefix(req.Sort, "-")
+	var less func(a, b *zip.File) bool
+
+	switch strings.TrimPrefix(req.Sort, "-") {
+	case "name":
+		less = func(a, b *zip.File) bool { return a.Name < b.Name }
+	case "size":
+		less = func(a, b *zip.File) bool { return a.UncompressedSize64 < b.UncompressedSize64 }
+	case "modified":
+		less = func(a, b *zip.File) bool { return a.Modified.Before(b.Modified) }
+	default:
+		// as stored in the zip
+		return selected
+	}
+
+	sort.SliceStable(selected, func(i, j int) bool {
+		if descending {
+			return less(selected[j], selected[i])
+		}
+		return less(selected[i], selected[j])
+	})
+	return selected
+}
+
+// parentDirectories returns the directories a file is in, innermost last
+func parentDirectories(name string) []string {
+	dirs := []string{}
+	for i, c := range name {
+		if c == '/' && i > 0 {
+			dirs = append(dirs, name[:i])
+		}
+	}
+	return dirs
+}
+
+// aggregateDirectories sums up files by directory, the root being ""
+func aggregateDirectories(files []*zip.File, req *ListRequest) []ListDirectory {
+	byPath := map[string]*ListDirectory{
+		"": &ListDirectory{Path: ""},
+	}
+
+	for _, file := range files {
+		for _, dir := range append([]string{""}, parentDirectories(file.Name)...) {
+			summary, ok := byPath[dir]
+			if !ok {
+				summary = &ListDirectory{Path: dir}
+				byPath[dir] = summary
+			}
+			summary.Files++
+			summary.Size += file.UncompressedSize64
+		}
+	}
+
+	dirs := []ListDirectory{}
+	for _, summary := range byPath {
+		dirs = append(dirs, *summary)
+	}
+
+	descending := strings.HasPrefix(req.Sort, "-")
+	sort.Slice(dirs, func(i, j int) bool {
+		a, b := dirs[i], dirs[j]
+		if descending {
+			a, b = b, a
+		}
+		if strings.TrimPrefix(req.Sort, "-") == "size" && a.Size != b.Size {
+			return a.Size < b.Size
+		}
+		return a.Path < b.Path
+	})
+	return dirs
+}
+
+// buildTree arranges files in a tree, whose root is returned
+func buildTree(files []*zip.File) *ListTreeNode {
+	root := &ListTreeNode{Directory: true}
+	dirs := map[string]*ListTreeNode{"": root}
+
+	var dirFor func(dirPath string) *ListTreeNode
+	dirFor = func(dirPath string) *ListTreeNode {
+		if node, ok := dirs[dirPath]; ok {
+			return node
+		}
+
+		parent := dirFor(parentPath(dirPath))
+		node := &ListTreeNode{Name: path.Base(dirPath), Directory: true}
+		parent.Children = append(parent.Children, node)
+		dirs[dirPath] = node
+		return node
+	}
+
+	for _, file := range files {
+		dir := dirFor(parentPath(file.Name))
+		dir.Children = append(dir.Children, &ListTreeNode{
+			Name: path.Base(file.Name),
+			Size: file.UncompressedSize64,
+		})
+
+		for _, dir := range append([]string{""}, parentDirectories(file.Name)...) {
+			dirs[dir].Files++
+			dirs[dir].Size += file.UncompressedSize64
+		}
+	}
+
+	return root
+}
+
+// parentPath is path.Dir, with "" for the root
+func parentPath(name string) string {
+	i := strings.LastIndex(name, "/")
+	if i == -1 {
+		return ""
+	}
+	return name[:i]
+}
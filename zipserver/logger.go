@@ -0,0 +1,258 @@
+package zipserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is the severity of a log line
+type LogLevel int
+
+// Log levels, from most to least verbose
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[LogLevel]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l LogLevel) String() string {
+	return levelNames[l]
+}
+
+// ParseLogLevel turns a level name (debug, info, warn, error) into a LogLevel
+func ParseLogLevel(name string) (LogLevel, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+
+	return LevelInfo, fmt.Errorf("Unknown log level: %s", name)
+}
+
+// logOutput is shared between a logger and all the loggers derived from it
+type logOutput struct {
+	sync.Mutex
+	writer io.Writer
+	level  LogLevel
+	json   bool
+}
+
+type logField struct {
+	key   string
+	value interface{}
+}
+
+// Logger writes leveled log lines, either as text or as JSON objects, with
+// a set of fields (request ID, job ID...) attached to every line
+type Logger struct {
+	out    *logOutput
+	fields []logField
+}
+
+// NewLogger creates a logger writing lines of at least the given level
+func NewLogger(writer io.Writer, level LogLevel, json bool) *Logger {
+	return &Logger{
+		out: &logOutput{
+			writer: writer,
+			level:  level,
+			json:   json,
+		},
+	}
+}
+
+// defaultLogger is used when there's no logger in context
+var defaultLogger = NewLogger(os.Stderr, LevelInfo, false)
+
+// SetupLogging configures the default logger from config
+func SetupLogging(config *Config) error {
+	level := LevelInfo
+	if config.LogLevel != "" {
+		var err error
+		level, err = ParseLogLevel(config.LogLevel)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch config.LogFormat {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("Unknown log format: %s", config.LogFormat)
+	}
+
+	defaultLogger.out.Lock()
+	defer defaultLogger.out.Unlock()
+	defaultLogger.out.level = level
+	defaultLogger.out.json = config.LogFormat == "json"
+	return nil
+}
+
+// With returns a logger that adds a field to every line
+func (l *Logger) With(key string, value interface{}) *Logger {
+	fields := make([]logField, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+
+	return &Logger{
+		out:    l.out,
+		fields: append(fields, logField{key, value}),
+	}
+}
+
+// Debugf logs a debug line, using fmt.Sprintf formatting
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(LevelDebug, format, args...)
+}
+
+// Infof logs an info line, using fmt.Sprintf formatting
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(LevelInfo, format, args...)
+}
+
+// Warnf logs a warning line, using fmt.Sprintf formatting
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(LevelWarn, format, args...)
+}
+
+// Errorf logs an error line, using fmt.Sprintf formatting
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(LevelError, format, args...)
+}
+
+func (l *Logger) logf(level LogLevel, format string, args ...interface{}) {
+	l.out.Lock()
+	defer l.out.Unlock()
+
+	if level < l.out.level {
+		return
+	}
+
+	now := time.Now()
+	msg := fmt.Sprintf(format, args...)
+
+	var line []byte
+	if l.out.json {
+		entry := map[string]interface{}{}
+		for _, field := range l.fields {
+			entry[field.key] = jsonFieldValue(field.value)
+		}
+		entry["time"] = now.Format(time.RFC3339Nano)
+		entry["level"] = level.String()
+		entry["msg"] = msg
+
+		blob, err := json.Marshal(entry)
+		if err != nil {
+			blob = []byte(fmt.Sprintf(`{"level":"error","msg":"could not format log line: %s"}`, err))
+		}
+		line = append(blob, '\n')
+	} else {
+		var sb strings.Builder
+		sb.WriteString(now.Format("2006/01/02 15:04:05 "))
+		sb.WriteString(strings.ToUpper(level.String()))
+		sb.WriteString(" ")
+		sb.WriteString(msg)
+		for _, field := range l.fields {
+			fmt.Fprintf(&sb, " %s=%v", field.key, field.value)
+		}
+		sb.WriteString("\n")
+		line = []byte(sb.String())
+	}
+
+	l.out.writer.Write(line)
+}
+
+// errors don't marshal to anything useful, use their message
+func jsonFieldValue(value interface{}) interface{} {
+	if err, ok := value.(error); ok {
+		return err.Error()
+	}
+	return value
+}
+
+type contextKey int
+
+const (
+	loggerKey contextKey = iota
+	requestIDKey
+	jobIDKey
+	abortKey
+	progressKey
+	eventsKey
+)
+
+// withLogger returns a copy of ctx carrying logger
+func withLogger(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
+
+// loggerFrom returns the logger carried by ctx, or the default logger
+func loggerFrom(ctx context.Context) *Logger {
+	if logger, ok := ctx.Value(loggerKey).(*Logger); ok {
+		return logger
+	}
+	return defaultLogger
+}
+
+// withRequestID returns a copy of ctx carrying the ID of the request it's
+// for, and a logger tagging every line with it
+func withRequestID(ctx context.Context, requestID string) context.Context {
+	ctx = context.WithValue(ctx, requestIDKey, requestID)
+	return withLogger(ctx, loggerFrom(ctx).With("request_id", requestID))
+}
+
+// requestIDFrom returns the request ID carried by ctx, if any
+func requestIDFrom(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey).(string)
+	return requestID
+}
+
+// withJobID returns a copy of ctx carrying the ID of the job it's for, and a
+// logger tagging every line with it
+func withJobID(ctx context.Context, jobID string) context.Context {
+	ctx = context.WithValue(ctx, jobIDKey, jobID)
+	return withLogger(ctx, loggerFrom(ctx).With("job_id", jobID))
+}
+
+// jobIDFrom returns the job ID carried by ctx, if any
+func jobIDFrom(ctx context.Context) string {
+	jobID, _ := ctx.Value(jobIDKey).(string)
+	return jobID
+}
+
+// newID generates a random identifier for a request or a job
+func newID() string {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		// crypto/rand never fails on supported platforms
+		panic(err)
+	}
+	return hex.EncodeToString(buf[:])
+}
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestIDFor returns the ID passed by the client in the X-Request-Id
+// header if it looks sane, a fresh one otherwise
+func requestIDFor(header string) string {
+	if validRequestID.MatchString(header) {
+		return header
+	}
+	return newID()
+}
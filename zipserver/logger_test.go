@@ -0,0 +1,58 @@
+package zipserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Logger(t *testing.T) {
+	var buf bytes.Buffer
+
+	logger := NewLogger(&buf, LevelInfo, false).With("job_id", "abc")
+	logger.Debugf("hidden")
+	logger.Infof("hello %s", "there")
+
+	line := buf.String()
+	assert.True(t, strings.Contains(line, "INFO hello there job_id=abc"), line)
+	assert.False(t, strings.Contains(line, "hidden"))
+
+	buf.Reset()
+	logger = NewLogger(&buf, LevelDebug, true)
+	logger.With("request_id", "xyz").With("err", errors.New("oops")).Warnf("uh %d", 1)
+	logger.Debugf("no fields")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.EqualValues(t, 2, len(lines))
+
+	var entry map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.EqualValues(t, "warn", entry["level"])
+	assert.EqualValues(t, "uh 1", entry["msg"])
+	assert.EqualValues(t, "xyz", entry["request_id"])
+	assert.EqualValues(t, "oops", entry["err"])
+
+	level, err := ParseLogLevel("WARN")
+	assert.NoError(t, err)
+	assert.EqualValues(t, LevelWarn, level)
+
+	_, err = ParseLogLevel("loud")
+	assert.Error(t, err)
+}
+
+func Test_RequestIDs(t *testing.T) {
+	assert.EqualValues(t, "from-client.1", requestIDFor("from-client.1"))
+	assert.EqualValues(t, 16, len(requestIDFor("")))
+	assert.EqualValues(t, 16, len(requestIDFor("spaces are not allowed")))
+	assert.NotEqual(t, newID(), newID())
+
+	ctx := withRequestID(context.Background(), "abc")
+	assert.EqualValues(t, "abc", requestIDFrom(ctx))
+	assert.True(t, loggerFrom(ctx) != defaultLogger)
+	assert.True(t, loggerFrom(context.Background()) == defaultLogger)
+}
@@ -2,11 +2,13 @@ package zipserver
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
-	"time"
 
 	errors "github.com/go-errors/errors"
 )
@@ -22,7 +24,11 @@ type MemStorage struct {
 	mutex        sync.Mutex
 	objects      map[string]memObject
 	failingPaths map[string]struct{}
-	putDelay     time.Duration
+	// paths that can be written but not deleted
+	failingDeletes map[string]struct{}
+	// called by uploads before anything is stored, which fail with what it
+	// returns. Lets tests stall uploads, or act while they're in flight
+	putHook func(ctx context.Context, key string) error
 }
 
 // interface guard
@@ -31,8 +37,9 @@ var _ Storage = (*MemStorage)(nil)
 // NewMemStorage creates a new fs storage working in the given directory
 func NewMemStorage() (*MemStorage, error) {
 	return &MemStorage{
-		objects:      make(map[string]memObject),
-		failingPaths: make(map[string]struct{}),
+		objects:        make(map[string]memObject),
+		failingPaths:   make(map[string]struct{}),
+		failingDeletes: make(map[string]struct{}),
 	}, nil
 }
 
@@ -40,8 +47,14 @@ func (fs *MemStorage) objectPath(bucket, key string) string {
 	return fmt.Sprintf("%s/%s", bucket, key)
 }
 
+func (fs *MemStorage) notFound(objectPath string) error {
+	se := newStorageError(http.StatusNotFound, "404 Not Found", objectPath)
+	se.Message = "object not found"
+	return se
+}
+
 // GetFile implements Storage.GetFile for FsStorage
-func (fs *MemStorage) GetFile(bucket, key string) (io.ReadCloser, error) {
+func (fs *MemStorage) GetFile(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
 	fs.mutex.Lock()
 	defer fs.mutex.Unlock()
 
@@ -51,8 +64,42 @@ func (fs *MemStorage) GetFile(bucket, key string) (io.ReadCloser, error) {
 		return io.NopCloser(bytes.NewReader(obj.data)), nil
 	}
 
-	err := fmt.Errorf("%s: object not found", objectPath)
-	return nil, errors.Wrap(err, 0)
+	return nil, errors.Wrap(fs.notFound(objectPath), 0)
+}
+
+// GetFileRange implements Storage.GetFileRange for FsStorage
+func (fs *MemStorage) GetFileRange(ctx context.Context, bucket, key string, offset, length int64) (io.ReadCloser, int64, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	objectPath := fs.objectPath(bucket, key)
+
+	if obj, ok := fs.objects[objectPath]; ok {
+		size := int64(len(obj.data))
+		start, end := resolveRange(offset, length, size)
+		return io.NopCloser(bytes.NewReader(obj.data[start:end])), size, nil
+	}
+
+	return nil, 0, errors.Wrap(fs.notFound(objectPath), 0)
+}
+
+// ListFiles implements Storage.ListFiles for FsStorage
+func (fs *MemStorage) ListFiles(ctx context.Context, bucket, prefix string) ([]StorageObject, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	objects := []StorageObject{}
+	bucketPrefix := fs.objectPath(bucket, "")
+
+	for objectPath, obj := range fs.objects {
+		key := strings.TrimPrefix(objectPath, bucketPrefix)
+		if strings.HasPrefix(objectPath, bucketPrefix) && strings.HasPrefix(key, prefix) {
+			objects = append(objects, StorageObject{key, uint64(len(obj.data))})
+		}
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
 }
 
 func (fs *MemStorage) getHeaders(bucket, key string) (http.Header, error) {
@@ -65,29 +112,34 @@ func (fs *MemStorage) getHeaders(bucket, key string) (http.Header, error) {
 		return obj.headers, nil
 	}
 
-	err := fmt.Errorf("%s: object not found", objectPath)
-	return nil, errors.Wrap(err, 0)
+	return nil, errors.Wrap(fs.notFound(objectPath), 0)
 }
 
 // PutFile implements Storage.PutFile for FsStorage
-func (fs *MemStorage) PutFile(bucket, key string, contents io.Reader, mimeType string) error {
-	return fs.PutFileWithSetup(bucket, key, contents, func(req *http.Request) error {
+func (fs *MemStorage) PutFile(ctx context.Context, bucket, key string, contents io.Reader, mimeType string) error {
+	return fs.PutFileWithSetup(ctx, bucket, key, contents, func(req *http.Request) error {
 		req.Header.Set("Content-Type", mimeType)
 		return nil
 	})
 }
 
 // PutFileWithSetup implements Storage.PutFileWithSetup for FsStorage
-func (fs *MemStorage) PutFileWithSetup(bucket, key string, contents io.Reader, setup StorageSetupFunc) error {
+func (fs *MemStorage) PutFileWithSetup(ctx context.Context, bucket, key string, contents io.Reader, setup StorageSetupFunc) error {
 	fs.mutex.Lock()
-	defer fs.mutex.Unlock()
-
 	objectPath := fs.objectPath(bucket, key)
-	if _, ok := fs.failingPaths[objectPath]; ok {
+	_, failing := fs.failingPaths[objectPath]
+	putHook := fs.putHook
+	fs.mutex.Unlock()
+
+	if failing {
 		return errors.Wrap(errors.New("intentional failure"), 0)
 	}
 
-	time.Sleep(fs.putDelay)
+	if putHook != nil {
+		if err := putHook(ctx, key); err != nil {
+			return errors.Wrap(err, 0)
+		}
+	}
 
 	req, err := http.NewRequest("PUT", "http://127.0.0.1/dummy", nil)
 	if err != nil {
@@ -99,11 +151,15 @@ func (fs *MemStorage) PutFileWithSetup(bucket, key string, contents io.Reader, s
 		return errors.Wrap(err, 0)
 	}
 
+	// contents may come from this storage, read them without holding the lock
 	data, err := io.ReadAll(contents)
 	if err != nil {
 		return errors.Wrap(err, 0)
 	}
 
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
 	fs.objects[objectPath] = memObject{
 		data,
 		req.Header,
@@ -113,11 +169,16 @@ func (fs *MemStorage) PutFileWithSetup(bucket, key string, contents io.Reader, s
 }
 
 // DeleteFile implements Storage.DeleteFile for FsStorage
-func (fs *MemStorage) DeleteFile(bucket, key string) error {
+func (fs *MemStorage) DeleteFile(ctx context.Context, bucket, key string) error {
 	fs.mutex.Lock()
 	defer fs.mutex.Unlock()
 
-	delete(fs.objects, fs.objectPath(bucket, key))
+	objectPath := fs.objectPath(bucket, key)
+	if _, ok := fs.failingDeletes[objectPath]; ok {
+		return errors.Wrap(errors.New("intentional delete failure"), 0)
+	}
+
+	delete(fs.objects, objectPath)
 	return nil
 }
 
@@ -129,3 +190,30 @@ func (fs *MemStorage) planForFailure(bucket, key string) {
 
 	fs.failingPaths[objectPath] = struct{}{}
 }
+
+// onPut sets the hook uploads call before storing anything
+func (fs *MemStorage) onPut(hook func(ctx context.Context, key string) error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	fs.putHook = hook
+}
+
+// stallPuts makes uploads under prefix hang until they're canceled
+func (fs *MemStorage) stallPuts(prefix string) {
+	fs.onPut(func(ctx context.Context, key string) error {
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		<-ctx.Done()
+		return ctx.Err()
+	})
+}
+
+func (fs *MemStorage) planForDeleteFailure(bucket, key string) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	fs.failingDeletes[fs.objectPath(bucket, key)] = struct{}{}
+}
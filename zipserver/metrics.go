@@ -0,0 +1,187 @@
+package zipserver
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "zipserver"
+
+var metrics = struct {
+	operations         *prometheus.CounterVec
+	downloadedBytes    *prometheus.CounterVec
+	uploadedBytes      *prometheus.CounterVec
+	filesPerExtraction prometheus.Histogram
+	fileUploadSeconds  prometheus.Histogram
+	storageErrors      *prometheus.CounterVec
+	storageRetries     *prometheus.CounterVec
+	inFlightJobs       *prometheus.GaugeVec
+	lockContentions    prometheus.Counter
+	orphanedObjects    prometheus.Counter
+}{
+	operations: promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "operations_total",
+		Help:      "Extractions, slurps and lists performed, by outcome",
+	}, []string{"operation", "outcome"}),
+
+	downloadedBytes: promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "downloaded_bytes_total",
+		Help:      "Bytes downloaded from storage or remote URLs",
+	}, []string{"operation"}),
+
+	uploadedBytes: promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "uploaded_bytes_total",
+		Help:      "Bytes uploaded to storage",
+	}, []string{"operation"}),
+
+	filesPerExtraction: promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "extraction_files",
+		Help:      "Number of files uploaded by successful extractions",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 8),
+	}),
+
+	fileUploadSeconds: promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "file_upload_seconds",
+		Help:      "Time taken to upload a single extracted file",
+		Buckets:   prometheus.DefBuckets,
+	}),
+
+	storageErrors: promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "storage_errors_total",
+		Help:      "Failed storage calls, by operation",
+	}, []string{"operation"}),
+
+	storageRetries: promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "storage_retries_total",
+		Help:      "Storage calls retried after a transient error, by operation",
+	}, []string{"operation"}),
+
+	inFlightJobs: promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "in_flight_jobs",
+		Help:      "Extractions and slurps currently running",
+	}, []string{"operation"}),
+
+	lockContentions: promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "prefix_lock_contentions_total",
+		Help:      "Times an extraction had to wait for another one writing to the same prefix",
+	}),
+
+	orphanedObjects: promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "orphaned_objects_total",
+		Help:      "Objects left behind by aborted extractions that could not be deleted",
+	}),
+}
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "tmp_disk_usage_bytes",
+		Help:      "Size of the zips currently downloaded to the temporary directory",
+	}, func() float64 {
+		return float64(tmpDiskUsage())
+	})
+}
+
+// outcomeLabel turns the result of an operation into a metrics label
+func outcomeLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// trackInFlight counts a job of the given operation as running until the
+// returned func is called
+func trackInFlight(operation string) func() {
+	gauge := metrics.inFlightJobs.WithLabelValues(operation)
+	gauge.Inc()
+	return gauge.Dec
+}
+
+// tmpDiskUsage returns the total size of files in tmpDir
+func tmpDiskUsage() int64 {
+	var total int64
+
+	filepath.WalkDir(tmpDir, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// files come and go while we walk, just skip them
+			return nil
+		}
+
+		if info, err := entry.Info(); err == nil && !entry.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	})
+
+	return total
+}
+
+// instrumentedStorage counts failed calls to the underlying storage
+type instrumentedStorage struct {
+	Storage
+}
+
+// interface guard
+var _ Storage = (*instrumentedStorage)(nil)
+
+func (is *instrumentedStorage) observe(operation string, err error) error {
+	if err != nil {
+		metrics.storageErrors.WithLabelValues(operation).Inc()
+	}
+	return err
+}
+
+// GetFile implements Storage.GetFile for instrumentedStorage
+func (is *instrumentedStorage) GetFile(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	reader, err := is.Storage.GetFile(ctx, bucket, key)
+	return reader, is.observe("get", err)
+}
+
+// GetFileRange implements Storage.GetFileRange for instrumentedStorage
+func (is *instrumentedStorage) GetFileRange(ctx context.Context, bucket, key string, offset, length int64) (io.ReadCloser, int64, error) {
+	reader, size, err := is.Storage.GetFileRange(ctx, bucket, key, offset, length)
+	return reader, size, is.observe("get", err)
+}
+
+// PutFile implements Storage.PutFile for instrumentedStorage
+func (is *instrumentedStorage) PutFile(ctx context.Context, bucket, key string, contents io.Reader, mimeType string) error {
+	return is.observe("put", is.Storage.PutFile(ctx, bucket, key, contents, mimeType))
+}
+
+// PutFileWithSetup implements Storage.PutFileWithSetup for instrumentedStorage
+func (is *instrumentedStorage) PutFileWithSetup(ctx context.Context, bucket, key string, contents io.Reader, setup StorageSetupFunc) error {
+	return is.observe("put", is.Storage.PutFileWithSetup(ctx, bucket, key, contents, setup))
+}
+
+// DeleteFile implements Storage.DeleteFile for instrumentedStorage
+func (is *instrumentedStorage) DeleteFile(ctx context.Context, bucket, key string) error {
+	return is.observe("delete", is.Storage.DeleteFile(ctx, bucket, key))
+}
+
+// ListFiles implements Storage.ListFiles for instrumentedStorage
+func (is *instrumentedStorage) ListFiles(ctx context.Context, bucket, prefix string) ([]StorageObject, error) {
+	objects, err := is.Storage.ListFiles(ctx, bucket, prefix)
+	return objects, is.observe("list", err)
+}
+
+// observeDuration records the time elapsed since start in a histogram
+func observeDuration(histogram prometheus.Observer, start time.Time) {
+	histogram.Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,50 @@
+package zipserver
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_InstrumentedStorage(t *testing.T) {
+	memStorage, err := NewMemStorage()
+	assert.NoError(t, err)
+	memStorage.planForFailure("bucket", "failing")
+
+	storage := &instrumentedStorage{memStorage}
+	putErrors := metrics.storageErrors.WithLabelValues("put")
+	getErrors := metrics.storageErrors.WithLabelValues("get")
+	putBefore := testutil.ToFloat64(putErrors)
+	getBefore := testutil.ToFloat64(getErrors)
+
+	err = storage.PutFile(context.Background(), "bucket", "fine", strings.NewReader("hi"), "text/plain")
+	assert.NoError(t, err)
+	assert.EqualValues(t, putBefore, testutil.ToFloat64(putErrors))
+
+	err = storage.PutFile(context.Background(), "bucket", "failing", strings.NewReader("hi"), "text/plain")
+	assert.Error(t, err)
+	assert.EqualValues(t, putBefore+1, testutil.ToFloat64(putErrors))
+
+	_, err = storage.GetFile(context.Background(), "bucket", "missing")
+	assert.Error(t, err)
+	assert.EqualValues(t, getBefore+1, testutil.ToFloat64(getErrors))
+}
+
+func Test_TmpDiskUsage(t *testing.T) {
+	err := os.MkdirAll(tmpDir, os.ModeDir|0777)
+	assert.NoError(t, err)
+
+	before := tmpDiskUsage()
+
+	fname := path.Join(tmpDir, "metrics_test.zip")
+	err = os.WriteFile(fname, make([]byte, 1234), 0644)
+	assert.NoError(t, err)
+	defer os.Remove(fname)
+
+	assert.EqualValues(t, before+1234, tmpDiskUsage())
+}
@@ -0,0 +1,231 @@
+package zipserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	errors "github.com/go-errors/errors"
+)
+
+// Orphan is an object an aborted extraction uploaded, then failed to delete
+type Orphan struct {
+	Bucket string
+	Key    string
+	// ID of the extraction that left it behind
+	JobID string `json:",omitempty"`
+	// last error we got trying to delete it
+	Error      string
+	RecordedAt time.Time
+}
+
+// orphanLog serializes access to the orphan log file within the process
+var orphanLog sync.Mutex
+
+// recordOrphans appends orphans to the log at logPath, one JSON object per
+// line. Without a log path, orphans are only logged.
+func recordOrphans(ctx context.Context, logPath string, orphans []Orphan) error {
+	logger := loggerFrom(ctx)
+	for _, orphan := range orphans {
+		logger.Errorf("Orphaned object %s/%s: %s", orphan.Bucket, orphan.Key, orphan.Error)
+	}
+	metrics.orphanedObjects.Add(float64(len(orphans)))
+
+	if logPath == "" || len(orphans) == 0 {
+		return nil
+	}
+
+	orphanLog.Lock()
+	defer orphanLog.Unlock()
+
+	file, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	encoder := json.NewEncoder(file)
+	for _, orphan := range orphans {
+		err = encoder.Encode(orphan)
+		if err != nil {
+			file.Close()
+			return errors.Wrap(err, 0)
+		}
+	}
+
+	err = file.Close()
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+// readOrphans returns every orphan recorded in the log at logPath, a missing
+// log has none. Callers must hold orphanLog.
+func readOrphans(logPath string) ([]Orphan, error) {
+	orphans := []Orphan{}
+
+	file, err := os.Open(logPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return orphans, nil
+		}
+		return nil, errors.Wrap(err, 0)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var orphan Orphan
+		err = json.Unmarshal(scanner.Bytes(), &orphan)
+		if err != nil {
+			return nil, errors.Wrap(err, 0)
+		}
+		orphans = append(orphans, orphan)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	return orphans, nil
+}
+
+// writeOrphans replaces the log at logPath with orphans. Callers must hold
+// orphanLog.
+func writeOrphans(logPath string, orphans []Orphan) error {
+	tmp, err := os.CreateTemp(filepath.Dir(logPath), filepath.Base(logPath)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	defer os.Remove(tmp.Name())
+
+	encoder := json.NewEncoder(tmp)
+	for _, orphan := range orphans {
+		err = encoder.Encode(orphan)
+		if err != nil {
+			tmp.Close()
+			return errors.Wrap(err, 0)
+		}
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	// renaming is atomic, a crash mid-sweep can't lose the log
+	err = os.Rename(tmp.Name(), logPath)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+// ListOrphans returns the orphans recorded in the log configured in config
+func ListOrphans(config *Config) ([]Orphan, error) {
+	if config.OrphanLogPath == "" {
+		return []Orphan{}, nil
+	}
+
+	orphanLog.Lock()
+	defer orphanLog.Unlock()
+
+	return readOrphans(config.OrphanLogPath)
+}
+
+// SweepResult lists orphans deleted by a sweep, and those still there
+type SweepResult struct {
+	Swept     []Orphan
+	Remaining []Orphan
+}
+
+// SweepOrphans tries deleting every orphan recorded in the log configured in
+// config, and keeps only those it couldn't delete in it
+func SweepOrphans(ctx context.Context, config *Config) (*SweepResult, error) {
+	if config.OrphanLogPath == "" {
+		return &SweepResult{[]Orphan{}, []Orphan{}}, nil
+	}
+
+	storage, err := newStorage(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return sweepOrphans(ctx, storage, config.OrphanLogPath)
+}
+
+func sweepOrphans(ctx context.Context, storage Storage, logPath string) (*SweepResult, error) {
+	// extractions failing in the meantime wait for the sweep to be done
+	// before recording their own orphans
+	orphanLog.Lock()
+	defer orphanLog.Unlock()
+
+	orphans, err := readOrphans(logPath)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := loggerFrom(ctx)
+	logger.Infof("Sweeping %d orphans", len(orphans))
+
+	result := &SweepResult{[]Orphan{}, []Orphan{}}
+	for _, orphan := range orphans {
+		err := storage.DeleteFile(ctx, orphan.Bucket, orphan.Key)
+		if err == nil || isStorageNotFound(err) {
+			result.Swept = append(result.Swept, orphan)
+			continue
+		}
+
+		logger.Warnf("Could not sweep %s/%s: %s", orphan.Bucket, orphan.Key, err.Error())
+		orphan.Error = err.Error()
+		result.Remaining = append(result.Remaining, orphan)
+	}
+
+	if len(orphans) > 0 {
+		err = writeOrphans(logPath, result.Remaining)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	logger.Infof("Swept %d orphans, %d remaining", len(result.Swept), len(result.Remaining))
+	return result, nil
+}
+
+func orphansHandler(w http.ResponseWriter, r *http.Request) error {
+	orphans, err := ListOrphans(config)
+	if err != nil {
+		return err
+	}
+
+	return writeJSONMessage(w, struct {
+		Orphans []Orphan
+	}{orphans})
+}
+
+func sweepOrphansHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requirePost(w, r); err != nil {
+		return writeJSONError(w, "SweepError", err)
+	}
+
+	result, err := SweepOrphans(r.Context(), config)
+	if err != nil {
+		return writeJSONError(w, "SweepError", err)
+	}
+
+	return writeJSONMessage(w, struct {
+		Success bool
+		*SweepResult
+	}{true, result})
+}
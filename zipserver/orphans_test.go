@@ -0,0 +1,109 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_AbortRecordsOrphans(t *testing.T) {
+	config := emptyConfig()
+	config.OrphanLogPath = filepath.Join(t.TempDir(), "orphans.jsonl")
+
+	storage, err := NewMemStorage()
+	assert.NoError(t, err)
+
+	archiver := &Archiver{storage, config}
+	prefix := "zipserver_test/orphans"
+	zipPath := "orphans_test.zip"
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	zl := &zipLayout{
+		entries: []zipEntry{
+			zipEntry{name: "1", data: []byte("uh oh")},
+			zipEntry{name: "2", data: []byte("uh oh")},
+		},
+	}
+	zl.Write(t, zw)
+	assert.NoError(t, zw.Close())
+
+	err = storage.PutFile(context.Background(), config.Bucket, zipPath, bytes.NewReader(buf.Bytes()), "application/zip")
+	assert.NoError(t, err)
+
+	orphanKey := fmt.Sprintf("%s/%s", prefix, "1")
+	storage.planForFailure(config.Bucket, fmt.Sprintf("%s/%s", prefix, "2"))
+	storage.planForDeleteFailure(config.Bucket, orphanKey)
+
+	// one at a time, so 1 is uploaded by the time 2 fails
+	limits := testLimits()
+	limits.ExtractionThreads = 1
+
+	ctx := withJobID(context.Background(), "job1")
+	_, err = archiver.ExtractZip(ctx, zipPath, prefix, limits)
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "intentional failure"))
+
+	assert.EqualValues(t, 2, len(storage.objects), "only the zip and the undeletable file are left")
+
+	orphans, err := ListOrphans(config)
+	assert.NoError(t, err)
+	if assert.EqualValues(t, 1, len(orphans)) {
+		assert.EqualValues(t, config.Bucket, orphans[0].Bucket)
+		assert.EqualValues(t, orphanKey, orphans[0].Key)
+		assert.EqualValues(t, "job1", orphans[0].JobID)
+		assert.True(t, strings.Contains(orphans[0].Error, "intentional delete failure"))
+	}
+
+	// still can't delete it, it stays in the log
+	result, err := sweepOrphans(context.Background(), storage, config.OrphanLogPath)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, len(result.Swept))
+	assert.EqualValues(t, 1, len(result.Remaining))
+
+	orphans, err = ListOrphans(config)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, len(orphans))
+
+	delete(storage.failingDeletes, storage.objectPath(config.Bucket, orphanKey))
+
+	result, err = sweepOrphans(context.Background(), storage, config.OrphanLogPath)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, len(result.Swept))
+	assert.EqualValues(t, 0, len(result.Remaining))
+	assert.EqualValues(t, 1, len(storage.objects), "only the zip is left")
+
+	orphans, err = ListOrphans(config)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, len(orphans))
+}
+
+func Test_SweepOrphansMissingLog(t *testing.T) {
+	storage, err := NewMemStorage()
+	assert.NoError(t, err)
+
+	logPath := filepath.Join(t.TempDir(), "orphans.jsonl")
+	result, err := sweepOrphans(context.Background(), storage, logPath)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, len(result.Swept))
+	assert.EqualValues(t, 0, len(result.Remaining))
+
+	_, err = os.Stat(logPath)
+	assert.True(t, os.IsNotExist(err), "sweeping nothing doesn't create the log")
+}
+
+func Test_SweepOrphansHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	assert.NoError(t, sweepOrphansHandler(rec, httptest.NewRequest("GET", "/orphans/sweep", nil)))
+	assert.EqualValues(t, http.StatusMethodNotAllowed, rec.Code, "sweeping deletes objects, GETs can't")
+	assert.EqualValues(t, "POST", rec.Header().Get("Allow"))
+}
@@ -0,0 +1,234 @@
+package zipserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Progress is how far along an extraction is
+type Progress struct {
+	FilesDone     int
+	FilesTotal    int
+	BytesUploaded uint64
+	BytesTotal    uint64
+}
+
+// progressTracker accumulates the progress of a job as workers report it.
+// A nil tracker ignores updates, so code can report progress unconditionally.
+type progressTracker struct {
+	sync.Mutex
+	progress Progress
+	// bumped on every update, tells whether there's anything new to report
+	version uint64
+}
+
+func (pt *progressTracker) setTotals(files int, bytes uint64) {
+	if pt == nil {
+		return
+	}
+
+	pt.Lock()
+	defer pt.Unlock()
+	pt.progress.FilesTotal = files
+	pt.progress.BytesTotal = bytes
+	pt.version++
+}
+
+func (pt *progressTracker) addBytes(bytes uint64) {
+	if pt == nil || bytes == 0 {
+		return
+	}
+
+	pt.Lock()
+	defer pt.Unlock()
+	pt.progress.BytesUploaded += bytes
+	pt.version++
+}
+
+func (pt *progressTracker) fileDone() {
+	if pt == nil {
+		return
+	}
+
+	pt.Lock()
+	defer pt.Unlock()
+	pt.progress.FilesDone++
+	pt.version++
+}
+
+// snapshot returns the current progress along with its version
+func (pt *progressTracker) snapshot() (Progress, uint64) {
+	pt.Lock()
+	defer pt.Unlock()
+	return pt.progress, pt.version
+}
+
+// withProgress returns a copy of ctx that progress is reported to
+func withProgress(ctx context.Context, pt *progressTracker) context.Context {
+	return context.WithValue(ctx, progressKey, pt)
+}
+
+// progressFrom returns the tracker progress should be reported to, nil if
+// nobody's interested
+func progressFrom(ctx context.Context) *progressTracker {
+	pt, _ := ctx.Value(progressKey).(*progressTracker)
+	return pt
+}
+
+// progressTick is how often we check whether progress callbacks are due,
+// it's a variable so tests can speed it up
+var progressTick = time.Second
+
+var errUnknownJob = errors.New("Unknown job")
+
+// jobRetention is how long a finished job's status stays available
+const jobRetention = 10 * time.Minute
+
+// reportProgress posts progress to the job's callbacks that asked for it,
+// no more often than they asked for, until the returned function is called
+func (job *extractJob) reportProgress(ctx context.Context) func() {
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(progressTick)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				job.sendProgress(ctx)
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+func (job *extractJob) sendProgress(ctx context.Context) {
+	progress, version := job.progress.snapshot()
+	now := time.Now()
+
+	shared.Lock()
+	due := []jobCallback{}
+	for i := range job.callbacks {
+		callback := &job.callbacks[i]
+		if callback.progressInterval <= 0 || callback.progressVersion == version {
+			continue
+		}
+		if now.Sub(callback.progressSentAt) < callback.progressInterval {
+			continue
+		}
+
+		callback.progressSentAt = now
+		callback.progressVersion = version
+		due = append(due, *callback)
+	}
+	shared.Unlock()
+
+	if len(due) == 0 {
+		return
+	}
+
+	resValues := url.Values{}
+	resValues.Add("JobID", job.id)
+	resValues.Add("Processing", "true")
+	addProgressValues(resValues, progress)
+
+	for _, callback := range due {
+		notifyCallback(ctx, callback, resValues)
+	}
+}
+
+// addProgressValues describes progress in the values posted to callbacks
+func addProgressValues(values url.Values, progress Progress) {
+	values.Add("Progress[FilesDone]", fmt.Sprintf("%d", progress.FilesDone))
+	values.Add("Progress[FilesTotal]", fmt.Sprintf("%d", progress.FilesTotal))
+	values.Add("Progress[BytesUploaded]", fmt.Sprintf("%d", progress.BytesUploaded))
+	values.Add("Progress[BytesTotal]", fmt.Sprintf("%d", progress.BytesTotal))
+}
+
+// findJob returns the running or recently finished extraction with the
+// given ID, if any
+func findJob(jobID string) *extractJob {
+	shared.Lock()
+	defer shared.Unlock()
+
+	return shared.jobsByID[jobID]
+}
+
+// forgetJobLater drops a finished job from the status registry once its
+// status has been available for long enough
+func forgetJobLater(job *extractJob) {
+	time.AfterFunc(jobRetention, func() {
+		shared.Lock()
+		defer shared.Unlock()
+
+		if shared.jobsByID[job.id] == job {
+			delete(shared.jobsByID, job.id)
+		}
+	})
+}
+
+// status returns the job's state (waiting for its prefix, running, done or
+// failed) and the error it failed with, if any
+func (job *extractJob) status() (string, error) {
+	shared.Lock()
+	defer shared.Unlock()
+
+	select {
+	case <-job.done:
+		if job.err != nil {
+			return "failed", job.err
+		}
+		return "done", nil
+	default:
+	}
+
+	if job.running {
+		return "running", nil
+	}
+	return "waiting", nil
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) error {
+	params := r.URL.Query()
+	jobID, err := getParam(params, "job")
+	if err != nil {
+		return err
+	}
+
+	job := findJob(jobID)
+	if job == nil {
+		return writeJSONError(w, "StatusError", fmt.Errorf("%w: %s", errUnknownJob, jobID))
+	}
+
+	status, jobErr := job.status()
+	progress, _ := job.progress.snapshot()
+
+	var errMessage string
+	if jobErr != nil {
+		errMessage = jobErr.Error()
+	}
+
+	return writeJSONMessage(w, struct {
+		JobID    string
+		Key      string
+		Prefix   string
+		Status   string
+		Error    string `json:",omitempty"`
+		Progress Progress
+	}{job.id, job.key, job.prefix, status, errMessage, progress})
+}
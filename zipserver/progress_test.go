@@ -0,0 +1,123 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ExtractProgress(t *testing.T) {
+	var nilTracker *progressTracker
+	nilTracker.setTotals(1, 1)
+	nilTracker.addBytes(1)
+	nilTracker.fileDone()
+
+	storage, err := NewMemStorage()
+	assert.NoError(t, err)
+	archiver := &Archiver{storage, emptyConfig()}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	zl := &zipLayout{
+		entries: []zipEntry{
+			zipEntry{name: "1", data: []byte("one")},
+			zipEntry{name: "2", data: []byte("two, longer")},
+		},
+	}
+	zl.Write(t, zw)
+	assert.NoError(t, zw.Close())
+
+	fname := filepath.Join(t.TempDir(), "progress.zip")
+	assert.NoError(t, os.WriteFile(fname, buf.Bytes(), 0644))
+
+	tracker := &progressTracker{}
+	ctx := withProgress(context.Background(), tracker)
+	events := newEventLog()
+	ctx = withEvents(ctx, events)
+	_, err = archiver.sendZipExtracted(ctx, "zipserver_test/progress", fname, testLimits())
+	assert.NoError(t, err)
+
+	progress, _ := tracker.snapshot()
+	assert.EqualValues(t, Progress{
+		FilesDone:     2,
+		FilesTotal:    2,
+		BytesUploaded: 14,
+		BytesTotal:    14,
+	}, progress)
+
+	published, _, _ := events.since(0)
+	if assert.EqualValues(t, 2, len(published)) {
+		for _, event := range published {
+			assert.EqualValues(t, "uploaded", event.name)
+		}
+	}
+}
+
+func Test_ProgressCallbacks(t *testing.T) {
+	defer func(tick time.Duration) { progressTick = tick }(progressTick)
+	progressTick = 5 * time.Millisecond
+
+	var mutex sync.Mutex
+	received := []url.Values{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		mutex.Lock()
+		received = append(received, r.PostForm)
+		mutex.Unlock()
+	}))
+	defer ts.Close()
+
+	job, started := startOrJoinJob(jobKey{key: "progress.zip", prefix: "progress"}, ts.URL, "progress-job", time.Millisecond)
+	assert.True(t, started)
+
+	job.run(context.Background(), func(ctx context.Context) ([]ExtractedFile, error) {
+		progress := progressFrom(ctx)
+		progress.setTotals(2, 10)
+		time.Sleep(30 * time.Millisecond)
+		progress.addBytes(5)
+		progress.fileDone()
+		time.Sleep(30 * time.Millisecond)
+		progress.addBytes(5)
+		progress.fileDone()
+		return nil, nil
+	})
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if assert.True(t, len(received) >= 2, "should get progress, then the result") {
+		first := received[0]
+		assert.EqualValues(t, "true", first.Get("Processing"))
+		assert.EqualValues(t, "2", first.Get("Progress[FilesTotal]"))
+		assert.EqualValues(t, "10", first.Get("Progress[BytesTotal]"))
+
+		last := received[len(received)-1]
+		assert.EqualValues(t, "true", last.Get("Success"), "the result comes last")
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/status?job="+job.id, nil)
+	assert.NoError(t, statusHandler(rec, req))
+
+	var status struct {
+		JobID    string
+		Status   string
+		Progress Progress
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	assert.EqualValues(t, job.id, status.JobID)
+	assert.EqualValues(t, "done", status.Status)
+	assert.EqualValues(t, 2, status.Progress.FilesDone)
+	assert.EqualValues(t, 10, status.Progress.BytesUploaded)
+}
@@ -0,0 +1,223 @@
+package zipserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	errors "github.com/go-errors/errors"
+)
+
+// rangeBlockSize is the least we fetch with each range request. zip reads
+// the central directory in small chunks, and looks for its end in the last
+// 65KB of the file
+const rangeBlockSize = 128 * 1024
+
+// rangeHeader builds a Range header for length bytes from offset, or for the
+// last length bytes if offset is negative
+func rangeHeader(offset, length int64) string {
+	if offset < 0 {
+		return fmt.Sprintf("bytes=-%d", length)
+	}
+	return fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+}
+
+// resolveRange returns where the range asked for with offset and length
+// starts and ends in a resource of the given size
+func resolveRange(offset, length, size int64) (int64, int64) {
+	start := offset
+	if offset < 0 {
+		start = size - length
+		if start < 0 {
+			start = 0
+		}
+	}
+
+	end := start + length
+	if end > size {
+		end = size
+	}
+	if start > end {
+		start = end
+	}
+	return start, end
+}
+
+// rangeSize returns the size of the whole resource a successful response to
+// a range request is part of, and whether the response is only that range.
+// Servers ignoring ranges respond with all of it.
+func rangeSize(res *http.Response) (int64, bool, error) {
+	if res.StatusCode == http.StatusPartialContent {
+		// bytes first-last/size
+		contentRange := res.Header.Get("Content-Range")
+		slash := strings.LastIndex(contentRange, "/")
+		if !strings.HasPrefix(contentRange, "bytes ") || slash == -1 {
+			return 0, false, fmt.Errorf("Invalid Content-Range: %q", contentRange)
+		}
+
+		size, err := strconv.ParseInt(contentRange[slash+1:], 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("Unknown size in Content-Range: %q", contentRange)
+		}
+		return size, true, nil
+	}
+
+	if res.ContentLength < 0 {
+		return 0, false, errors.New("Unknown content length")
+	}
+	return res.ContentLength, false, nil
+}
+
+// rangeStart returns where the range a 206 response is made of starts
+func rangeStart(res *http.Response) (int64, error) {
+	var start int64
+	_, err := fmt.Sscanf(res.Header.Get("Content-Range"), "bytes %d-", &start)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid Content-Range: %q", res.Header.Get("Content-Range"))
+	}
+	return start, nil
+}
+
+// readCloser closes something else than what it reads
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// rangeOfBody reads the range asked for out of the body of a response to a
+// range request, which is all of it if the server ignored the range
+func rangeOfBody(res *http.Response, offset, length int64) (io.ReadCloser, int64, error) {
+	size, partial, err := rangeSize(res)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if partial {
+		return res.Body, size, nil
+	}
+
+	start, end := resolveRange(offset, length, size)
+	_, err = io.CopyN(io.Discard, res.Body, start)
+	if err != nil {
+		return nil, 0, err
+	}
+	return readCloser{io.LimitReader(res.Body, end-start), res.Body}, size, nil
+}
+
+// rangeFetcher fetches length bytes from offset of something, or its last
+// length bytes if offset is negative, and tells its size
+type rangeFetcher func(ctx context.Context, offset, length int64) (io.ReadCloser, int64, error)
+
+// rangedReaderAt reads a remote file with range requests, so zip can list it
+// without downloading all of it. It keeps the last block fetched around.
+type rangedReaderAt struct {
+	ctx   context.Context
+	fetch rangeFetcher
+	size  int64
+
+	mutex       sync.Mutex
+	block       []byte
+	blockOffset int64
+	// total fetched so far
+	fetched int64
+}
+
+var _ io.ReaderAt = (*rangedReaderAt)(nil)
+
+// newRangedReaderAt fetches the end of the file, where the zip central
+// directory is, and learns its size along the way
+func newRangedReaderAt(ctx context.Context, fetch rangeFetcher) (*rangedReaderAt, error) {
+	ra := &rangedReaderAt{ctx: ctx, fetch: fetch}
+
+	reader, size, err := fetch(ctx, -1, rangeBlockSize)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	ra.size = size
+	start, _ := resolveRange(-1, rangeBlockSize, size)
+	err = ra.fill(reader, start)
+	if err != nil {
+		return nil, err
+	}
+
+	return ra, nil
+}
+
+func (ra *rangedReaderAt) fill(reader io.Reader, offset int64) error {
+	block, err := io.ReadAll(reader)
+	ra.fetched += int64(len(block))
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	ra.block = block
+	ra.blockOffset = offset
+	return nil
+}
+
+// ReadAt implements io.ReaderAt
+func (ra *rangedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= ra.size {
+		return 0, io.EOF
+	}
+
+	ra.mutex.Lock()
+	defer ra.mutex.Unlock()
+
+	n := 0
+	for n < len(p) && off < ra.size {
+		blockEnd := ra.blockOffset + int64(len(ra.block))
+		if off < ra.blockOffset || off >= blockEnd {
+			length := int64(len(p) - n)
+			if length < rangeBlockSize {
+				length = rangeBlockSize
+			}
+
+			reader, _, err := ra.fetch(ra.ctx, off, length)
+			if err != nil {
+				return n, err
+			}
+			err = ra.fill(reader, off)
+			reader.Close()
+			if err != nil {
+				return n, err
+			}
+			if len(ra.block) == 0 {
+				return n, io.ErrUnexpectedEOF
+			}
+			continue
+		}
+
+		copied := copy(p[n:], ra.block[off-ra.blockOffset:])
+		n += copied
+		off += int64(copied)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// setContext changes the context further fetches are made with
+func (ra *rangedReaderAt) setContext(ctx context.Context) {
+	ra.mutex.Lock()
+	defer ra.mutex.Unlock()
+	ra.ctx = ctx
+}
+
+// bytesFetched returns how much was downloaded so far
+func (ra *rangedReaderAt) bytesFetched() int64 {
+	ra.mutex.Lock()
+	defer ra.mutex.Unlock()
+	return ra.fetched
+}
@@ -1,9 +1,10 @@
 package zipserver
 
 import (
-	"fmt"
+	"archive/zip"
+	"context"
+	"hash/crc32"
 	"io"
-	"log"
 )
 
 type readerClosure func(p []byte) (int, error)
@@ -16,7 +17,7 @@ func (fn readerClosure) Read(p []byte) (int, error) {
 func annotatedReader(reader io.Reader) readerClosure {
 	return func(p []byte) (int, error) {
 		bytesRead, err := reader.Read(p)
-		log.Printf("Read %d bytes", bytesRead)
+		defaultLogger.Debugf("Read %d bytes", bytesRead)
 		return bytesRead, err
 	}
 }
@@ -29,7 +30,58 @@ func limitedReader(reader io.Reader, maxBytes uint64, totalBytes *uint64) reader
 		*totalBytes += uint64(bytesRead)
 
 		if *totalBytes > maxBytes {
-			return bytesRead, fmt.Errorf("File too large (max %d bytes)", maxBytes)
+			return bytesRead, limitExceeded("File too large (max %d bytes)", maxBytes)
+		}
+
+		return bytesRead, err
+	}
+}
+
+// wraps a reader to track the total amount of bytes read
+func countingReader(reader io.Reader, totalBytes *uint64) readerClosure {
+	return func(p []byte) (int, error) {
+		bytesRead, err := reader.Read(p)
+		*totalBytes += uint64(bytesRead)
+		return bytesRead, err
+	}
+}
+
+// wraps a reader to fail as soon as ctx is canceled
+func contextReader(ctx context.Context, reader io.Reader) readerClosure {
+	return func(p []byte) (int, error) {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		return reader.Read(p)
+	}
+}
+
+// wraps a reader to report bytes read as uploaded to a progress tracker.
+// *position is how far into the upload the reader is: when the upload starts
+// over, bytes that were already reported aren't reported again.
+func progressReader(reader io.Reader, progress *progressTracker, position *uint64) readerClosure {
+	reported := *position
+	return func(p []byte) (int, error) {
+		bytesRead, err := reader.Read(p)
+		if *position > reported {
+			progress.addBytes(*position - reported)
+			reported = *position
+		}
+		return bytesRead, err
+	}
+}
+
+// wraps a reader to fail at the end if what was read doesn't have the
+// expected CRC-32, like the contents of a zip entry
+func checksummedReader(reader io.Reader, expected uint32) readerClosure {
+	hash := crc32.NewIEEE()
+	return func(p []byte) (int, error) {
+		bytesRead, err := reader.Read(p)
+		hash.Write(p[:bytesRead])
+
+		if err == io.EOF && hash.Sum32() != expected {
+			return bytesRead, zip.ErrChecksum
 		}
 
 		return bytesRead, err
@@ -2,6 +2,7 @@ package zipserver
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"os"
 	"testing"
@@ -45,3 +46,19 @@ func Test_limitedReader(t *testing.T) {
 	result, err = io.ReadAll(lr)
 	assert.Error(t, err)
 }
+
+func Test_contextReader(t *testing.T) {
+	s := "Hello, world"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cr := contextReader(ctx, bytes.NewReader([]byte(s)))
+
+	buf := make([]byte, 5)
+	n, err := cr.Read(buf)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "Hello", string(buf[:n]))
+
+	cancel()
+	_, err = cr.Read(buf)
+	assert.Equal(t, context.Canceled, err)
+}
@@ -0,0 +1,308 @@
+package zipserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// retryPolicy is how many times, and how patiently, we try a storage call
+type retryPolicy struct {
+	attempts  int
+	baseDelay time.Duration
+	maxDelay  time.Duration
+}
+
+// delay returns how long to wait before the given retry (1 for the first
+// retry), doubling every time with jitter so that workers failing together
+// don't all come back together
+func (rp retryPolicy) delay(retry int) time.Duration {
+	delay := rp.baseDelay
+	for i := 1; i < retry && delay < rp.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > rp.maxDelay {
+		delay = rp.maxDelay
+	}
+
+	if delay <= 0 {
+		return 0
+	}
+
+	// somewhere between half and all of the delay
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// isRetryable returns true if err looks transient: a storage error of the
+// Transient kind, a dropped connection, or a network timeout
+func isRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var se *StorageError
+	if errors.As(err, &se) {
+		return se.Kind == StorageTransient
+	}
+
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return false
+}
+
+// retryingStorage retries calls to the underlying storage that fail with
+// transient errors, with exponential backoff. It can only retry what the
+// underlying storage reports as failed: GcsStorage must turn error responses
+// into StorageErrors, uploads included.
+type retryingStorage struct {
+	Storage
+	get, put, delete retryPolicy
+}
+
+// interface guard
+var _ Storage = (*retryingStorage)(nil)
+
+func newRetryingStorage(storage Storage, config *Config) *retryingStorage {
+	policy := func(attempts int) retryPolicy {
+		if attempts < 1 {
+			attempts = 1
+		}
+
+		return retryPolicy{
+			attempts:  attempts,
+			baseDelay: time.Duration(config.StorageRetryBaseDelayMs) * time.Millisecond,
+			maxDelay:  time.Duration(config.StorageRetryMaxDelayMs) * time.Millisecond,
+		}
+	}
+
+	return &retryingStorage{
+		Storage: storage,
+		get:     policy(config.StorageGetAttempts),
+		put:     policy(config.StoragePutAttempts),
+		delete:  policy(config.StorageDeleteAttempts),
+	}
+}
+
+// retry calls fn until it succeeds, fails with an error that isn't worth
+// retrying, or we run out of attempts. before is called ahead of every retry.
+func (rs *retryingStorage) retry(ctx context.Context, policy retryPolicy, operation, bucket, key string, before func() error, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= policy.attempts || !isRetryable(err) {
+			return err
+		}
+
+		delay := policy.delay(attempt)
+		loggerFrom(ctx).Warnf("%s %s/%s failed (attempt %d/%d), retrying in %s: %s",
+			operation, bucket, key, attempt, policy.attempts, delay, err.Error())
+		metrics.storageRetries.WithLabelValues(operation).Inc()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+
+		if before != nil {
+			if rewindErr := before(); rewindErr != nil {
+				return rewindErr
+			}
+		}
+	}
+}
+
+// GetFile implements Storage.GetFile for retryingStorage
+func (rs *retryingStorage) GetFile(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	var reader io.ReadCloser
+	err := rs.retry(ctx, rs.get, "get", bucket, key, nil, func() error {
+		var err error
+		reader, err = rs.Storage.GetFile(ctx, bucket, key)
+		return err
+	})
+	return reader, err
+}
+
+// GetFileRange implements Storage.GetFileRange for retryingStorage
+func (rs *retryingStorage) GetFileRange(ctx context.Context, bucket, key string, offset, length int64) (io.ReadCloser, int64, error) {
+	var reader io.ReadCloser
+	var size int64
+	err := rs.retry(ctx, rs.get, "get", bucket, key, nil, func() error {
+		var err error
+		reader, size, err = rs.Storage.GetFileRange(ctx, bucket, key, offset, length)
+		return err
+	})
+	return reader, size, err
+}
+
+// PutFile implements Storage.PutFile for retryingStorage
+func (rs *retryingStorage) PutFile(ctx context.Context, bucket, key string, contents io.Reader, mimeType string) error {
+	if rs.put.attempts <= 1 {
+		// no need to keep the body around
+		return rs.Storage.PutFile(ctx, bucket, key, contents, mimeType)
+	}
+
+	body := newRewindableReader(contents)
+	defer body.cleanup()
+
+	return rs.retry(ctx, rs.put, "put", bucket, key, body.rewind, func() error {
+		return rs.Storage.PutFile(ctx, bucket, key, body, mimeType)
+	})
+}
+
+// PutFileWithSetup implements Storage.PutFileWithSetup for retryingStorage
+func (rs *retryingStorage) PutFileWithSetup(ctx context.Context, bucket, key string, contents io.Reader, setup StorageSetupFunc) error {
+	if rs.put.attempts <= 1 {
+		// no need to keep the body around
+		return rs.Storage.PutFileWithSetup(ctx, bucket, key, contents, setup)
+	}
+
+	body := newRewindableReader(contents)
+	defer body.cleanup()
+
+	return rs.retry(ctx, rs.put, "put", bucket, key, body.rewind, func() error {
+		return rs.Storage.PutFileWithSetup(ctx, bucket, key, body, setup)
+	})
+}
+
+// DeleteFile implements Storage.DeleteFile for retryingStorage
+func (rs *retryingStorage) DeleteFile(ctx context.Context, bucket, key string) error {
+	return rs.retry(ctx, rs.delete, "delete", bucket, key, nil, func() error {
+		return rs.Storage.DeleteFile(ctx, bucket, key)
+	})
+}
+
+// ListFiles implements Storage.ListFiles for retryingStorage
+func (rs *retryingStorage) ListFiles(ctx context.Context, bucket, prefix string) ([]StorageObject, error) {
+	var objects []StorageObject
+	err := rs.retry(ctx, rs.get, "list", bucket, prefix, nil, func() error {
+		var err error
+		objects, err = rs.Storage.ListFiles(ctx, bucket, prefix)
+		return err
+	})
+	return objects, err
+}
+
+// reopenableReader is a PUT body that can start over by reopening what it
+// reads, eg. a zip entry, so retries don't need a copy of it
+type reopenableReader struct {
+	io.Reader
+	// makes the next Read start over from the beginning
+	reopen func() error
+}
+
+// rewindableReader lets a PUT body be sent again. Seekable readers are
+// simply seeked back to where they started, reopenable ones are reopened,
+// anything else is spooled to a temporary file as it's read, then replayed
+// from there.
+// It's deliberately not an io.Closer: http.Client closes request bodies after
+// each attempt, and we need it to survive until the last one.
+type rewindableReader struct {
+	source io.Reader
+
+	// set if source can seek
+	seeker io.Seeker
+	start  int64
+
+	// set if source can be reopened
+	reopen func() error
+
+	// everything read from source so far, if it can't seek or reopen
+	spool *os.File
+	// bytes of spool already replayed, -1 when not replaying
+	replayed int64
+}
+
+func newRewindableReader(source io.Reader) *rewindableReader {
+	rr := &rewindableReader{source: source, replayed: -1}
+
+	if reopenable, ok := source.(*reopenableReader); ok {
+		rr.reopen = reopenable.reopen
+		return rr
+	}
+
+	if seeker, ok := source.(io.Seeker); ok {
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err == nil {
+			rr.seeker = seeker
+			rr.start = start
+		}
+	}
+
+	return rr
+}
+
+func (rr *rewindableReader) Read(p []byte) (int, error) {
+	if rr.replayed >= 0 {
+		n, err := rr.spool.ReadAt(p, rr.replayed)
+		rr.replayed += int64(n)
+		if err == io.EOF {
+			// caught up with what was read before, back to source
+			rr.replayed = -1
+			if n > 0 {
+				return n, nil
+			}
+		} else {
+			return n, err
+		}
+	}
+
+	n, err := rr.source.Read(p)
+	if n > 0 && rr.seeker == nil && rr.reopen == nil {
+		if rr.spool == nil {
+			os.MkdirAll(tmpDir, os.ModeDir|0777)
+			spool, spoolErr := os.CreateTemp(tmpDir, "put_spool")
+			if spoolErr != nil {
+				return n, spoolErr
+			}
+			rr.spool = spool
+		}
+
+		// ReadAt doesn't move the file offset, so writes always append
+		if _, spoolErr := rr.spool.Write(p[:n]); spoolErr != nil {
+			return n, spoolErr
+		}
+	}
+	return n, err
+}
+
+// rewind makes the next Read start over from the beginning
+func (rr *rewindableReader) rewind() error {
+	if rr.seeker != nil {
+		_, err := rr.seeker.Seek(rr.start, io.SeekStart)
+		return err
+	}
+
+	if rr.reopen != nil {
+		return rr.reopen()
+	}
+
+	if rr.spool != nil {
+		rr.replayed = 0
+	}
+	return nil
+}
+
+// cleanup removes the spool file, if any. It doesn't close the source.
+func (rr *rewindableReader) cleanup() {
+	if rr.spool == nil {
+		return
+	}
+
+	rr.spool.Close()
+	os.Remove(rr.spool.Name())
+}
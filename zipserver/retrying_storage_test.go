@@ -0,0 +1,196 @@
+package zipserver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyStorage fails the first few calls after reading part of the body,
+// like a connection dropped mid-upload would
+type flakyStorage struct {
+	*MemStorage
+	failures int
+	err      error
+	calls    int
+}
+
+func (fs *flakyStorage) PutFileWithSetup(ctx context.Context, bucket, key string, contents io.Reader, setup StorageSetupFunc) error {
+	fs.calls++
+	if fs.calls <= fs.failures {
+		io.CopyN(io.Discard, contents, 3)
+		return fs.err
+	}
+	return fs.MemStorage.PutFileWithSetup(ctx, bucket, key, contents, setup)
+}
+
+func (fs *flakyStorage) DeleteFile(ctx context.Context, bucket, key string) error {
+	fs.calls++
+	if fs.calls <= fs.failures {
+		return fs.err
+	}
+	return fs.MemStorage.DeleteFile(ctx, bucket, key)
+}
+
+func testRetryConfig() *Config {
+	return &Config{
+		StorageGetAttempts:      3,
+		StoragePutAttempts:      3,
+		StorageDeleteAttempts:   3,
+		StorageRetryBaseDelayMs: 1,
+		StorageRetryMaxDelayMs:  5,
+	}
+}
+
+func Test_RetryingStorage(t *testing.T) {
+	ctx := context.Background()
+	unavailable := newStorageError(503, "503 Service Unavailable", "https://example.org")
+
+	for _, source := range []struct {
+		name   string
+		reader func() io.Reader
+	}{
+		{"seekable", func() io.Reader { return strings.NewReader("hello retries") }},
+		{"spooled", func() io.Reader { return io.MultiReader(strings.NewReader("hello retries")) }},
+	} {
+		memStorage, err := NewMemStorage()
+		assert.NoError(t, err)
+		flaky := &flakyStorage{MemStorage: memStorage, failures: 2, err: unavailable}
+		storage := newRetryingStorage(flaky, testRetryConfig())
+
+		err = storage.PutFileWithSetup(ctx, "bucket", "key", source.reader(), func(*http.Request) error { return nil })
+		assert.NoError(t, err, source.name)
+		assert.EqualValues(t, 3, flaky.calls, source.name)
+
+		reader, err := memStorage.GetFile(ctx, "bucket", "key")
+		assert.NoError(t, err)
+		data, err := io.ReadAll(reader)
+		assert.NoError(t, err)
+		assert.EqualValues(t, "hello retries", string(data), "%s body should be sent whole on retry", source.name)
+	}
+
+	// out of attempts
+	memStorage, err := NewMemStorage()
+	assert.NoError(t, err)
+	flaky := &flakyStorage{MemStorage: memStorage, failures: 5, err: unavailable}
+	err = newRetryingStorage(flaky, testRetryConfig()).DeleteFile(ctx, "bucket", "key")
+	assert.Equal(t, unavailable, err)
+	assert.EqualValues(t, 3, flaky.calls)
+
+	// not worth retrying
+	flaky = &flakyStorage{MemStorage: memStorage, failures: 5, err: newStorageError(403, "403 Forbidden", "https://example.org")}
+	err = newRetryingStorage(flaky, testRetryConfig()).DeleteFile(ctx, "bucket", "key")
+	assert.Error(t, err)
+	assert.EqualValues(t, 1, flaky.calls)
+
+	// no retries once canceled
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	flaky = &flakyStorage{MemStorage: memStorage, failures: 5, err: unavailable}
+	err = newRetryingStorage(flaky, testRetryConfig()).DeleteFile(canceled, "bucket", "key")
+	assert.Error(t, err)
+	assert.EqualValues(t, 1, flaky.calls)
+}
+
+func Test_RetryingGcsPuts(t *testing.T) {
+	ctx := context.Background()
+
+	var bodies []string
+	withFakeGcs(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if len(bodies) == 1 {
+			w.WriteHeader(503)
+			return
+		}
+		w.WriteHeader(200)
+	}, func(gcs *GcsStorage) {
+		storage := newRetryingStorage(gcs, testRetryConfig())
+		err := storage.PutFile(ctx, "bucket", "key", strings.NewReader("hello retries"), "text/plain")
+		assert.NoError(t, err)
+	})
+
+	// only works if a 503 response to the PUT is reported as an error
+	assert.EqualValues(t, []string{"hello retries", "hello retries"}, bodies, "the upload is retried whole")
+}
+
+func Test_IsRetryable(t *testing.T) {
+	assert.True(t, isRetryable(newStorageError(500, "500 Internal Server Error", "")))
+	assert.True(t, isRetryable(newStorageError(503, "503 Service Unavailable", "")))
+	assert.True(t, isRetryable(newStorageError(429, "429 Too Many Requests", "")))
+	assert.False(t, isRetryable(newStorageError(404, "404 Not Found", "")))
+	assert.True(t, isRetryable(fmt.Errorf("writing body: %w", syscall.ECONNRESET)))
+	assert.True(t, isRetryable(io.ErrUnexpectedEOF))
+	assert.False(t, isRetryable(context.Canceled))
+	assert.False(t, isRetryable(io.EOF))
+}
+
+func Test_RetryDelay(t *testing.T) {
+	policy := retryPolicy{attempts: 10, baseDelay: 100 * time.Millisecond, maxDelay: time.Second}
+
+	for retry, max := range map[int]time.Duration{
+		1: 100 * time.Millisecond,
+		2: 200 * time.Millisecond,
+		3: 400 * time.Millisecond,
+		9: time.Second,
+	} {
+		delay := policy.delay(retry)
+		assert.True(t, delay >= max/2 && delay <= max, "retry %d: %s should be within [%s, %s]", retry, delay, max/2, max)
+	}
+}
+
+func Test_RewindableReader(t *testing.T) {
+	rr := newRewindableReader(io.MultiReader(bytes.NewReader([]byte("0123456789"))))
+	defer rr.cleanup()
+
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(rr, buf)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "0123", string(buf))
+
+	assert.NoError(t, rr.rewind())
+	data, err := io.ReadAll(rr)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "0123456789", string(data))
+
+	assert.NoError(t, rr.rewind())
+	data, err = io.ReadAll(rr)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "0123456789", string(data))
+}
+
+func Test_RewindableReaderReopens(t *testing.T) {
+	opened := 0
+	var source io.Reader
+	reopenable := &reopenableReader{
+		Reader: readerClosure(func(p []byte) (int, error) { return source.Read(p) }),
+		reopen: func() error {
+			opened++
+			source = io.MultiReader(strings.NewReader("0123456789"))
+			return nil
+		},
+	}
+	assert.NoError(t, reopenable.reopen())
+
+	rr := newRewindableReader(reopenable)
+	defer rr.cleanup()
+
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(rr, buf)
+	assert.NoError(t, err)
+	assert.Nil(t, rr.spool, "reopenable readers shouldn't be spooled")
+
+	assert.NoError(t, rr.rewind())
+	data, err := io.ReadAll(rr)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "0123456789", string(data))
+	assert.EqualValues(t, 2, opened)
+}
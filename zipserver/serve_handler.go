@@ -0,0 +1,192 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// zipDirectory is the central directory of a zip in the bucket, kept around
+// to serve its files
+type zipDirectory struct {
+	key       string
+	files     map[string]*zip.File
+	fetchedAt time.Time
+}
+
+// resolve returns the file of the zip extraction would have uploaded to name,
+// rewrite rules included. Rewrites depend on the contents of files, which
+// are only checked once they're read.
+func (zd *zipDirectory) resolve(name string) *zip.File {
+	if file, ok := zd.files[name]; ok {
+		return file
+	}
+
+	for _, spec := range rewriteSpecs {
+		if strings.HasSuffix(name, spec.newExtension) {
+			original := strings.TrimSuffix(name, spec.newExtension) + spec.oldExtension
+			if file, ok := zd.files[original]; ok {
+				return file
+			}
+		}
+	}
+
+	return nil
+}
+
+// directoryCache keeps the central directories of the zips served last,
+// for ServeCacheTTL seconds, since the zips may be replaced
+type directoryCache struct {
+	sync.Mutex
+	// most recently used first
+	order *list.List
+	byKey map[string]*list.Element
+}
+
+var serveCache = &directoryCache{
+	order: list.New(),
+	byKey: make(map[string]*list.Element),
+}
+
+func (dc *directoryCache) get(key string, ttl time.Duration) *zipDirectory {
+	dc.Lock()
+	defer dc.Unlock()
+
+	element, ok := dc.byKey[key]
+	if !ok {
+		return nil
+	}
+
+	zd := element.Value.(*zipDirectory)
+	if time.Since(zd.fetchedAt) > ttl {
+		dc.order.Remove(element)
+		delete(dc.byKey, key)
+		return nil
+	}
+
+	dc.order.MoveToFront(element)
+	return zd
+}
+
+func (dc *directoryCache) put(zd *zipDirectory, size int) {
+	dc.Lock()
+	defer dc.Unlock()
+
+	if element, ok := dc.byKey[zd.key]; ok {
+		dc.order.Remove(element)
+	}
+	dc.byKey[zd.key] = dc.order.PushFront(zd)
+
+	for dc.order.Len() > size {
+		oldest := dc.order.Back()
+		dc.order.Remove(oldest)
+		delete(dc.byKey, oldest.Value.(*zipDirectory).key)
+	}
+}
+
+// loadZipDirectory reads the central directory of the zip at bucket/key with
+// range requests, from the cache if it's there
+func loadZipDirectory(ctx context.Context, storage Storage, bucket, key string, config *Config) (*zipDirectory, error) {
+	if config.ServeCacheSize > 0 {
+		if zd := serveCache.get(key, seconds(config.ServeCacheTTL)); zd != nil {
+			return zd, nil
+		}
+	}
+
+	readerAt, err := newRangedReaderAt(ctx, func(ctx context.Context, offset, length int64) (io.ReadCloser, int64, error) {
+		return storage.GetFileRange(ctx, bucket, key, offset, length)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	zipReader, err := zip.NewReader(readerAt, readerAt.size)
+	metrics.downloadedBytes.WithLabelValues("serve").Add(float64(readerAt.bytesFetched()))
+	if err != nil {
+		return nil, err
+	}
+
+	// outlives this request when cached, files read it to find their data
+	readerAt.setContext(context.Background())
+
+	zd := &zipDirectory{
+		key:       key,
+		files:     make(map[string]*zip.File),
+		fetchedAt: time.Now(),
+	}
+	for _, file := range zipReader.File {
+		if !strings.HasSuffix(file.Name, "/") {
+			zd.files[file.Name] = file
+		}
+	}
+
+	if config.ServeCacheSize > 0 {
+		serveCache.put(zd, config.ServeCacheSize)
+	}
+	return zd, nil
+}
+
+// splitServePath splits /serve/{zip key}/{path} at the first .zip segment,
+// paths to directories getting their index.html
+func splitServePath(urlPath string) (string, string, bool) {
+	rest := strings.TrimPrefix(urlPath, "/serve/")
+
+	i := strings.Index(rest, ".zip/")
+	if i == -1 {
+		return "", "", false
+	}
+
+	key := rest[:i+len(".zip")]
+	name := rest[i+len(".zip/"):]
+	if name == "" || strings.HasSuffix(name, "/") {
+		name += "index.html"
+	}
+	return key, name, true
+}
+
+// serveHandler serves files out of zips in the bucket like extracting them
+// would, from GET /serve/{zip key}/{path}
+func serveHandler(w http.ResponseWriter, r *http.Request) error {
+	key, name, ok := splitServePath(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return nil
+	}
+
+	storage, err := newStorage(config)
+	if storage == nil {
+		return err
+	}
+
+	started, err := serveZipFile(r.Context(), storage, config, key, name, w)
+	metrics.operations.WithLabelValues("serve", outcomeLabel(err)).Inc()
+
+	if err != nil {
+		loggerFrom(r.Context()).Errorf("Serving %s from %s failed: %s", name, key, err.Error())
+		if started {
+			return nil
+		}
+		return writeJSONError(w, "ServeError", err)
+	}
+	return nil
+}
+
+func serveZipFile(ctx context.Context, storage Storage, config *Config, key, name string, w http.ResponseWriter) (bool, error) {
+	zd, err := loadZipDirectory(ctx, storage, config.Bucket, key, config)
+	if err != nil {
+		return false, err
+	}
+
+	file := zd.resolve(name)
+	if file == nil || shouldIgnoreFile(file.Name) {
+		return false, fmt.Errorf("%w: %s", errNoSuchEntry, name)
+	}
+
+	return writeZipEntry(ctx, storage, config.Bucket, key, file, name, config.MaxFileSize, w, "serve")
+}
@@ -0,0 +1,112 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"container/list"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rangeCountingStorage counts ranged reads
+type rangeCountingStorage struct {
+	*MemStorage
+	ranges int
+}
+
+func (rcs *rangeCountingStorage) GetFileRange(ctx context.Context, bucket, key string, offset, length int64) (io.ReadCloser, int64, error) {
+	rcs.ranges++
+	return rcs.MemStorage.GetFileRange(ctx, bucket, key, offset, length)
+}
+
+func Test_SplitServePath(t *testing.T) {
+	cases := []struct {
+		path, key, name string
+		ok              bool
+	}{
+		{"/serve/game.zip/index.html", "game.zip", "index.html", true},
+		{"/serve/zips/12/game.zip/js/game.js", "zips/12/game.zip", "js/game.js", true},
+		{"/serve/game.zip/", "game.zip", "index.html", true},
+		{"/serve/game.zip/docs/", "game.zip", "docs/index.html", true},
+		{"/serve/game.zip", "", "", false},
+		{"/serve/game.tar/index.html", "", "", false},
+	}
+
+	for _, c := range cases {
+		key, name, ok := splitServePath(c.path)
+		assert.EqualValues(t, c.ok, ok, c.path)
+		assert.EqualValues(t, c.key, key, c.path)
+		assert.EqualValues(t, c.name, name, c.path)
+	}
+}
+
+func Test_ServeZipFile(t *testing.T) {
+	ctx := context.Background()
+	memStorage, err := NewMemStorage()
+	assert.NoError(t, err)
+	storage := &rangeCountingStorage{MemStorage: memStorage}
+
+	previousCache := serveCache
+	defer func() { serveCache = previousCache }()
+	serveCache = &directoryCache{order: list.New(), byKey: make(map[string]*list.Element)}
+
+	config := emptyConfig()
+	config.MaxFileSize = 1024 * 1024
+	config.ServeCacheSize = 10
+	config.ServeCacheTTL = 60
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	zl := &zipLayout{
+		entries: []zipEntry{
+			zipEntry{name: "index.html", data: []byte("<!doctype html><html></html>")},
+			zipEntry{name: "game.jsgz", data: []byte{0x1F, 0x8B, 0x08, 3, 7, 3, 4, 12, 53, 26, 34}},
+			zipEntry{name: "__MACOSX/._index.html", data: []byte("junk")},
+			zipEntry{name: "plain.jsgz", data: []byte("console.log('not gzipped')")},
+		},
+	}
+	zl.Write(t, zw)
+	assert.NoError(t, zw.Close())
+	assert.NoError(t, memStorage.PutFile(ctx, config.Bucket, "serve/game.zip", bytes.NewReader(buf.Bytes()), "application/zip"))
+
+	serve := func(name string) (*httptest.ResponseRecorder, error) {
+		rec := httptest.NewRecorder()
+		_, err := serveZipFile(ctx, storage, config, "serve/game.zip", name, rec)
+		return rec, err
+	}
+
+	rec, err := serve("index.html")
+	assert.NoError(t, err)
+	assert.EqualValues(t, "<!doctype html><html></html>", rec.Body.String())
+	assert.EqualValues(t, "text/html; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.EqualValues(t, 2, storage.ranges, "the end of the zip, then the file")
+
+	rec, err = serve("game.js")
+	assert.NoError(t, err, "rewrite rules apply")
+	assert.EqualValues(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.EqualValues(t, 3, storage.ranges, "the central directory is cached")
+
+	_, err = serve("game.jsgz")
+	assert.EqualValues(t, http.StatusNotFound, statusCodeFor(err), "extraction would have renamed it")
+
+	_, err = serve("plain.js")
+	assert.EqualValues(t, http.StatusNotFound, statusCodeFor(err), "only gzipped files are rewritten")
+
+	rec, err = serve("plain.jsgz")
+	assert.NoError(t, err)
+	assert.EqualValues(t, "", rec.Header().Get("Content-Encoding"))
+
+	_, err = serve("__MACOSX/._index.html")
+	assert.EqualValues(t, http.StatusNotFound, statusCodeFor(err), "ignored files aren't served")
+
+	_, err = serve("nope.html")
+	assert.EqualValues(t, http.StatusNotFound, statusCodeFor(err))
+
+	_, err = serveZipFile(ctx, storage, config, "serve/nope.zip", "index.html", httptest.NewRecorder())
+	assert.EqualValues(t, http.StatusNotFound, statusCodeFor(err))
+}
@@ -1,9 +1,9 @@
 package zipserver
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
 	"strings"
@@ -21,9 +21,9 @@ var _ http.Handler = (*memoryHttpHandler)(nil)
 
 func printError(err error) {
 	if se, ok := err.(*errors.Error); ok {
-		log.Printf("error: %s", se.ErrorStack())
+		defaultLogger.Errorf("error: %s", se.ErrorStack())
 	} else {
-		log.Printf("error: %s", se.Error())
+		defaultLogger.Errorf("error: %s", err.Error())
 	}
 }
 
@@ -37,9 +37,9 @@ func (mhh *memoryHttpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	path := strings.TrimPrefix(r.URL.Path, "/")
 
 	objectPath := fmt.Sprintf("%s/%s", mhh.prefix, path)
-	log.Printf("Requesting %s", objectPath)
+	defaultLogger.Infof("Requesting %s", objectPath)
 
-	reader, err := mhh.storage.GetFile(mhh.bucket, objectPath)
+	reader, err := mhh.storage.GetFile(r.Context(), mhh.bucket, objectPath)
 	if err != nil {
 		printError(err)
 		w.WriteHeader(404)
@@ -54,7 +54,7 @@ func (mhh *memoryHttpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	log.Printf("Headers: %v", headers)
+	defaultLogger.Debugf("Headers: %v", headers)
 
 	for k, vv := range headers {
 		for _, v := range vv {
@@ -88,7 +88,7 @@ func ServeZip(serve string) error {
 	}
 
 	key := "serve.zip"
-	err = storage.PutFile(config.Bucket, key, reader, "application/zip")
+	err = storage.PutFile(context.Background(), config.Bucket, key, reader, "application/zip")
 	if err != nil {
 		return errors.Wrap(err, 0)
 	}
@@ -96,7 +96,7 @@ func ServeZip(serve string) error {
 	archiver := &Archiver{storage, config}
 
 	prefix := "extracted"
-	_, err = archiver.ExtractZip(key, prefix, DefaultExtractLimits(config))
+	_, err = archiver.ExtractZip(context.Background(), key, prefix, DefaultExtractLimits(config))
 	if err != nil {
 		return errors.Wrap(err, 0)
 	}
@@ -107,6 +107,6 @@ func ServeZip(serve string) error {
 		Addr:    "localhost:8091",
 		Handler: handler,
 	}
-	log.Printf("Listening on %s...", s.Addr)
+	defaultLogger.Infof("Listening on %s...", s.Addr)
 	return s.ListenAndServe()
 }
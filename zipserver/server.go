@@ -1,23 +1,96 @@
 package zipserver
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 
-	"fmt"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var config *Config
 
 type errorHandler func(http.ResponseWriter, *http.Request) error
 
+// responseTracker remembers whether a response was started, after which an
+// error can no longer be sent to the client
+type responseTracker struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (rt *responseTracker) WriteHeader(statusCode int) {
+	rt.started = true
+	rt.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rt *responseTracker) Write(p []byte) (int, error) {
+	rt.started = true
+	return rt.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher for streaming handlers
+func (rt *responseTracker) Flush() {
+	if flusher, ok := rt.ResponseWriter.(http.Flusher); ok {
+		rt.started = true
+		flusher.Flush()
+	}
+}
+
+// ServeHTTP gives every request an ID, echoed in the X-Request-Id response
+// header and attached to every log line written while handling it. Each
+// request is traced, continuing the trace found in its headers if any.
 func (fn errorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if err := fn(w, r); err != nil {
-		http.Error(w, err.Error(), 500)
+	requestID := requestIDFor(r.Header.Get("X-Request-Id"))
+	w.Header().Set("X-Request-Id", requestID)
+
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := startSpan(ctx, r.URL.Path,
+		semconv.HTTPMethodKey.String(r.Method),
+		// the query string may carry signed URLs and headers
+		semconv.HTTPTargetKey.String(r.URL.Path),
+		attribute.String("request_id", requestID),
+	)
+
+	r = r.WithContext(withRequestID(ctx, requestID))
+	logger := loggerFrom(r.Context())
+	logger.Infof("%s %s", r.Method, r.URL.Path)
+
+	tracker := &responseTracker{ResponseWriter: w}
+	err := fn(tracker, r)
+	if err != nil {
+		logger.Errorf("%s", err.Error())
+		kind := "ServerError"
+		var re *RequestError
+		if errors.As(err, &re) {
+			kind = "RequestError"
+		}
+		if !tracker.started {
+			writeJSONError(w, kind, err)
+		}
 	}
+	endSpan(span, err)
+}
+
+// jobContext returns ctx, which controls the lifetime of a job, carrying the
+// logger and trace span of the request that started it so the job's log
+// lines and spans can be tied back to that request
+func jobContext(ctx context.Context, r *http.Request, jobID string) context.Context {
+	ctx = trace.ContextWithSpan(ctx, trace.SpanFromContext(r.Context()))
+	ctx = withLogger(ctx, loggerFrom(r.Context()))
+	return withJobID(ctx, jobID)
 }
 
 // get the first value of param or error
@@ -25,7 +98,7 @@ func getParam(params url.Values, name string) (string, error) {
 	val := params.Get(name)
 
 	if val == "" {
-		return "", fmt.Errorf("Missing param %v", name)
+		return "", missingParam(name)
 	}
 
 	return val, nil
@@ -60,36 +133,153 @@ func getIntParam(params url.Values, name string) (int, error) {
 }
 
 func writeJSONMessage(w http.ResponseWriter, msg interface{}) error {
+	return writeJSONMessageWithStatus(w, http.StatusOK, msg)
+}
+
+func writeJSONMessageWithStatus(w http.ResponseWriter, status int, msg interface{}) error {
 	blob, err := json.Marshal(msg)
 	if err != nil {
 		return err
 	}
 	w.Header()["Content-Type"] = []string{"application/json"}
+	w.WriteHeader(status)
 	w.Write(blob)
 	return nil
 }
 
+// errorMessage is the JSON body of error responses
+type errorMessage struct {
+	Type         string
+	Error        string
+	StorageError *storageErrorDetails `json:",omitempty"`
+	Timeout      *timeoutDetails      `json:",omitempty"`
+}
+
+func newErrorMessage(kind string, err error) errorMessage {
+	return errorMessage{kind, err.Error(), storageErrorDetailsOf(err), timeoutDetailsOf(err)}
+}
+
+// writeJSONError describes err to the client, with the HTTP status matching
+// it. If err was caused by storage,
+// the details are included so the client can tell eg. a missing zip from a
+// permission problem.
 func writeJSONError(w http.ResponseWriter, kind string, err error) error {
-	return writeJSONMessage(w, struct {
-		Type  string
-		Error string
-	}{kind, err.Error()})
+	return writeJSONMessageWithStatus(w, statusCodeFor(err), newErrorMessage(kind, err))
 }
 
-// StartZipServer starts listening for extract and slurp requests
+// addErrorValues describes err in the values posted to async callbacks,
+// mirroring writeJSONError
+func addErrorValues(values url.Values, kind string, err error) {
+	values.Add("Type", kind)
+	values.Add("Error", err.Error())
+
+	if details := storageErrorDetailsOf(err); details != nil {
+		values.Add("StorageError[Kind]", string(details.Kind))
+		values.Add("StorageError[StatusCode]", strconv.Itoa(details.StatusCode))
+		if details.Code != "" {
+			values.Add("StorageError[Code]", details.Code)
+		}
+		if details.Message != "" {
+			values.Add("StorageError[Message]", details.Message)
+		}
+	}
+
+	if details := timeoutDetailsOf(err); details != nil {
+		values.Add("Timeout[Operation]", details.Operation)
+		values.Add("Timeout[Seconds]", strconv.FormatFloat(details.Seconds, 'f', -1, 64))
+	}
+}
+
+// StartZipServer starts listening for extract and slurp requests. On SIGINT
+// or SIGTERM, it stops accepting requests and waits for in-flight work
+// before returning.
 func StartZipServer(listenTo string, _config *Config) error {
 	config = _config
 
+	mux := http.NewServeMux()
+
 	// Extract a .zip file (downloaded from GCS), stores each
 	// individual file on GCS in a given bucket/prefix
-	http.Handle("/extract", errorHandler(extractHandler))
+	mux.Handle("/extract", errorHandler(extractHandler))
 
 	// show the files in the zip
-	http.Handle("/list", errorHandler(listHandler))
+	mux.Handle("/list", errorHandler(listHandler))
+
+	// Zip objects of the bucket into a new zip, the reverse of /extract
+	mux.Handle("/bundle", errorHandler(bundleHandler))
+
+	// Stream a zip of objects of the bucket to the client
+	mux.Handle("/download", errorHandler(downloadHandler))
+
+	// stream a single file out of a zip
+	mux.Handle("/entry", errorHandler(entryHandler))
+
+	// serve the files of zips as if they were extracted
+	mux.Handle("/serve/", errorHandler(serveHandler))
 
 	// Download a file from an http{,s} URL and store it on GCS
-	http.Handle("/slurp", errorHandler(slurpHandler))
+	mux.Handle("/slurp", errorHandler(slurpHandler))
+
+	// Download a zip from a URL and extract it, storing the zip too if asked
+	mux.Handle("/slurp/extract", errorHandler(slurpExtractHandler))
+
+	// Progress of a running or recently finished extraction by job ID
+	mux.Handle("/status", errorHandler(statusHandler))
+
+	// Server-Sent Events for each file of an extraction, by job ID
+	mux.Handle("/jobs/", errorHandler(jobEventsHandler))
+
+	// Abort a running extraction or slurp by job ID
+	mux.Handle("/cancel", errorHandler(cancelHandler))
+
+	// Objects failed extractions could not clean up, and a way to delete them
+	mux.Handle("/orphans", errorHandler(orphansHandler))
+	mux.Handle("/orphans/sweep", errorHandler(sweepOrphansHandler))
+
+	// Prometheus metrics
+	mux.Handle("/metrics", promhttp.Handler())
+
+	// Probes for the orchestrator: is the process alive, can it take work
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+
+	server := &http.Server{
+		Addr:    listenTo,
+		Handler: mux,
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		defaultLogger.Infof("Listening on: %s", listenTo)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-serverErr:
+		return err
+	case sig := <-signals:
+		defaultLogger.Infof("Received %s, shutting down", sig)
+	}
+
+	timeout := time.Duration(config.ShutdownTimeout) * time.Second
+
+	// the server stops accepting connections and waits for active requests
+	// (sync extractions and slurps), while background work is drained on
+	// the side. Draining aborts stragglers, which unblocks those requests.
+	shutdownErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout+abortGracePeriod)
+		defer cancel()
+		shutdownErr <- server.Shutdown(ctx)
+	}()
+
+	drainWork(timeout)
 
-	log.Print("Listening on: " + listenTo)
-	return http.ListenAndServe(listenTo, nil)
+	err := <-shutdownErr
+	defaultLogger.Infof("Shutdown complete")
+	return err
 }
@@ -0,0 +1,60 @@
+package zipserver
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	goerrors "github.com/go-errors/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ErrorReporting(t *testing.T) {
+	se := newStorageError(404, "404 Not Found", "https://storage.googleapis.com/bucket/key")
+	se.Code = "NoSuchKey"
+	wrapped := goerrors.Wrap(se, 0)
+
+	rec := httptest.NewRecorder()
+	assert.NoError(t, writeJSONError(rec, "ExtractError", wrapped))
+	assert.JSONEq(t, `{
+		"Type": "ExtractError",
+		"Error": "404 Not Found https://storage.googleapis.com/bucket/key: NoSuchKey",
+		"StorageError": {"Kind": "NotFound", "StatusCode": 404, "Code": "NoSuchKey"}
+	}`, rec.Body.String())
+	assert.EqualValues(t, 404, rec.Code)
+
+	rec = httptest.NewRecorder()
+	assert.NoError(t, writeJSONError(rec, "SlurpError", errors.New("nope")))
+	assert.JSONEq(t, `{"Type": "SlurpError", "Error": "nope"}`, rec.Body.String())
+	assert.EqualValues(t, 500, rec.Code)
+
+	values := url.Values{}
+	addErrorValues(values, "ExtractError", wrapped)
+	assert.EqualValues(t, "NotFound", values.Get("StorageError[Kind]"))
+	assert.EqualValues(t, "404", values.Get("StorageError[StatusCode]"))
+	assert.EqualValues(t, "NoSuchKey", values.Get("StorageError[Code]"))
+}
+
+func Test_ErrorAfterResponseStarted(t *testing.T) {
+	handler := errorHandler(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Write([]byte("PK"))
+		return errors.New("cut short")
+	})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/download?prefix=a", nil))
+	assert.EqualValues(t, 200, rec.Code)
+	assert.EqualValues(t, "PK", rec.Body.String(), "no error appended to a started response")
+
+	handler = errorHandler(func(w http.ResponseWriter, r *http.Request) error {
+		return errors.New("nope")
+	})
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/download?prefix=a", nil))
+	assert.EqualValues(t, 500, rec.Code)
+	assert.JSONEq(t, `{"Type": "ServerError", "Error": "nope"}`, rec.Body.String())
+}
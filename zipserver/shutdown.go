@@ -0,0 +1,116 @@
+package zipserver
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// abortGracePeriod is how long aborted work gets to clean up after itself
+// (delete partial uploads, deliver callbacks) before we exit regardless
+const abortGracePeriod = 30 * time.Second
+
+var errShuttingDown = errors.New("zipserver is shutting down")
+
+var background struct {
+	// protects draining and inFlight, so no work is added while we wait for the rest
+	sync.Mutex
+	sync.WaitGroup
+	draining bool
+	inFlight int
+
+	// parent of every unit of work, canceled to abort them all
+	ctx   context.Context
+	abort func(reason error)
+}
+
+func init() {
+	background.ctx, background.abort = withAbort(context.Background())
+}
+
+// beginWork registers a unit of in-flight work (an extraction, a slurp) that
+// shutdown must wait for. The returned context is canceled if shutdown gives
+// up waiting, and done must be called once the work, callbacks included, is
+// finished. It fails once the server is shutting down.
+func beginWork() (context.Context, func(), error) {
+	background.Lock()
+	defer background.Unlock()
+
+	if background.draining {
+		return nil, nil, errShuttingDown
+	}
+
+	background.Add(1)
+	background.inFlight++
+	return background.ctx, finishWork, nil
+}
+
+func finishWork() {
+	background.Lock()
+	background.inFlight--
+	background.Unlock()
+
+	background.Done()
+}
+
+// workStatus returns how many units of work are in flight, and whether
+// we're shutting down
+func workStatus() (inFlight int, draining bool) {
+	background.Lock()
+	defer background.Unlock()
+
+	return background.inFlight, background.draining
+}
+
+// waitForWork waits for all in-flight work to be done, returns false
+// if it's still going after timeout
+func waitForWork(timeout time.Duration) bool {
+	finished := make(chan struct{})
+	go func() {
+		background.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// drainWork stops accepting new work, then waits for in-flight work to
+// finish. Whatever is still running after timeout gets aborted.
+func drainWork(timeout time.Duration) {
+	background.Lock()
+	background.draining = true
+	background.Unlock()
+
+	defaultLogger.Infof("Waiting up to %s for in-flight work", timeout)
+	if waitForWork(timeout) {
+		return
+	}
+
+	defaultLogger.Warnf("In-flight work still running, aborting it")
+	background.abort(errShuttingDown)
+
+	if !waitForWork(abortGracePeriod) {
+		defaultLogger.Errorf("Aborted work did not finish in time, exiting anyway")
+	}
+}
+
+// detachedContext carries the values of its parent (logger, span) but is
+// never canceled, so cleanup can go on after the work itself was aborted
+type detachedContext struct {
+	parent context.Context
+}
+
+func detachContext(ctx context.Context) context.Context {
+	return detachedContext{ctx}
+}
+
+func (dc detachedContext) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (dc detachedContext) Done() <-chan struct{}             { return nil }
+func (dc detachedContext) Err() error                        { return nil }
+func (dc detachedContext) Value(key interface{}) interface{} { return dc.parent.Value(key) }
@@ -0,0 +1,44 @@
+package zipserver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_DrainWork(t *testing.T) {
+	defer func() {
+		// leave things usable for other tests
+		background.Lock()
+		background.draining = false
+		background.ctx, background.abort = withAbort(context.Background())
+		background.Unlock()
+	}()
+
+	ctx, done, err := beginWork()
+	assert.NoError(t, err)
+
+	finished := make(chan struct{})
+	go func() {
+		// well-behaved work finishes soon after being aborted
+		<-ctx.Done()
+		time.Sleep(10 * time.Millisecond)
+		done()
+		close(finished)
+	}()
+
+	drainWork(20 * time.Millisecond)
+
+	select {
+	case <-finished:
+	default:
+		t.Fatal("drainWork should wait for aborted work")
+	}
+
+	assert.Equal(t, errShuttingDown, abortReason(ctx))
+
+	_, _, err = beginWork()
+	assert.Equal(t, errShuttingDown, err, "no new work while draining")
+}
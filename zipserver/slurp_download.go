@@ -0,0 +1,376 @@
+package zipserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSlurpConnections caps how many connections a single download opens
+const maxSlurpConnections = 16
+
+// fetchError is a URL responding with an unexpected status
+type fetchError struct {
+	statusCode int
+}
+
+func (fe *fetchError) Error() string {
+	return fmt.Sprintf("Failed to fetch file: %d", fe.statusCode)
+}
+
+var errRangeMismatch = errors.New("Server didn't respond with the range asked for")
+
+// isRetryableFetch is isRetryable for downloads, where servers failing or
+// asking us to slow down are worth trying again
+func isRetryableFetch(err error) bool {
+	var fe *fetchError
+	if errors.As(err, &fe) {
+		return fe.statusCode >= 500 || fe.statusCode == http.StatusTooManyRequests
+	}
+	return isRetryable(err)
+}
+
+// fileWriter writes to a file from an offset, so chunks of it can be written
+// concurrently
+type fileWriter struct {
+	file   *os.File
+	offset int64
+}
+
+func (fw *fileWriter) Write(p []byte) (int, error) {
+	n, err := fw.file.WriteAt(p, fw.offset)
+	fw.offset += int64(n)
+	return n, err
+}
+
+// urlDownload downloads a URL to a temporary file. When the connection
+// drops, the download resumes where it stopped with a range request, and
+// servers supporting ranges can be downloaded from over several connections
+// at once, a chunk at a time.
+type urlDownload struct {
+	url     string
+	headers map[string]string
+	// fail if the file is larger than this, 0 means no limit
+	maxBytes    uint64
+	connections int
+	chunkSize   int64
+	// attempts are counted since the download last got further
+	policy retryPolicy
+	// what downloaded bytes are counted as in metrics
+	operation string
+
+	// learned from the response with the whole file, or the first chunk
+	contentType string
+	// sent as If-Range when resuming, so we don't stitch together two
+	// versions of the file
+	validator string
+}
+
+func newURLDownload(config *Config, url string, headers map[string]string, maxBytes uint64, operation string) *urlDownload {
+	attempts := config.SlurpAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	chunkSize := int64(config.SlurpChunkSize)
+	if chunkSize < rangeBlockSize {
+		chunkSize = rangeBlockSize
+	}
+
+	return &urlDownload{
+		url:         url,
+		headers:     headers,
+		maxBytes:    maxBytes,
+		connections: config.SlurpConnections,
+		chunkSize:   chunkSize,
+		policy: retryPolicy{
+			attempts:  attempts,
+			baseDelay: time.Duration(config.StorageRetryBaseDelayMs) * time.Millisecond,
+			maxDelay:  time.Duration(config.StorageRetryMaxDelayMs) * time.Millisecond,
+		},
+		operation: operation,
+	}
+}
+
+// request GETs the URL from offset to end (excluded), or to the end of the
+// file if end is -1
+func (d *urlDownload) request(ctx context.Context, offset, end int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", d.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, value := range d.headers {
+		req.Header.Set(name, value)
+	}
+
+	if end >= 0 {
+		req.Header.Set("Range", rangeHeader(offset, end-offset))
+	} else if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	if req.Header.Get("Range") != "" && d.validator != "" {
+		req.Header.Set("If-Range", d.validator)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+		res.Body.Close()
+		return nil, &fetchError{res.StatusCode}
+	}
+	return res, nil
+}
+
+// learn remembers what a response tells about the file
+func (d *urlDownload) learn(res *http.Response) {
+	d.contentType = res.Header.Get("Content-Type")
+
+	// weak validators can't be used with If-Range
+	if etag := res.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		d.validator = etag
+	} else {
+		d.validator = res.Header.Get("Last-Modified")
+	}
+}
+
+// copyBody writes the body of res to dest from *pos, which it advances. A
+// 200 response is the whole file again,
+// which restarts the download unless only a chunk of it was asked for.
+func (d *urlDownload) copyBody(ctx context.Context, dest *os.File, res *http.Response, pos *int64, end int64) error {
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		start, err := rangeStart(res)
+		if err != nil || start != *pos {
+			return errRangeMismatch
+		}
+	case http.StatusOK:
+		if end >= 0 {
+			return errRangeMismatch
+		}
+
+		*pos = 0
+		d.learn(res)
+		if d.maxBytes > 0 && res.ContentLength > int64(d.maxBytes) {
+			return limitExceeded("Content-Length is greater than max bytes (%d > %d)",
+				res.ContentLength, d.maxBytes)
+		}
+	}
+
+	body := io.Reader(contextReader(ctx, res.Body))
+	if end >= 0 {
+		body = io.LimitReader(body, end-*pos)
+	}
+	if d.maxBytes > 0 {
+		totalBytes := uint64(*pos)
+		body = limitedReader(body, d.maxBytes, &totalBytes)
+	}
+
+	written, err := io.Copy(&fileWriter{dest, *pos}, body)
+	*pos += written
+	metrics.downloadedBytes.WithLabelValues(d.operation).Add(float64(written))
+
+	if err == nil && end >= 0 && *pos < end {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// fetchSpan downloads the file from start to end (excluded, -1 for all of
+// it) into dest, resuming where it stopped after transient errors. res is
+// the response to start from, if it was already requested. Returns where
+// the download stopped.
+func (d *urlDownload) fetchSpan(ctx context.Context, dest *os.File, start, end int64, res *http.Response) (int64, error) {
+	pos := start
+	// a restarted download only makes progress past this
+	furthest := start
+
+	for failures := 1; ; failures++ {
+		var err error
+		if res == nil {
+			res, err = d.request(ctx, pos, end)
+		}
+
+		if err == nil {
+			err = d.copyBody(ctx, dest, res, &pos, end)
+			res.Body.Close()
+			res = nil
+
+			if err == nil {
+				return pos, nil
+			}
+			if pos > furthest {
+				furthest = pos
+				failures = 1
+			}
+		}
+
+		if failures >= d.policy.attempts || !isRetryableFetch(err) {
+			return pos, err
+		}
+
+		delay := d.policy.delay(failures)
+		loggerFrom(ctx).Warnf("Downloading %s failed at byte %d (attempt %d/%d), resuming in %s: %s",
+			d.url, pos, failures, d.policy.attempts, delay, err.Error())
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return pos, err
+		case <-timer.C:
+		}
+	}
+}
+
+// parallel downloads a file of the given size in chunks, over several
+// connections. first is the response for the first chunk.
+func (d *urlDownload) parallel(ctx context.Context, dest *os.File, size int64, first *http.Response) error {
+	// in case it's never picked up
+	defer first.Body.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var failOnce sync.Once
+	var failure error
+	fail := func(err error) {
+		failOnce.Do(func() {
+			failure = err
+			cancel()
+		})
+	}
+
+	workers := d.connections
+	if chunks := int((size + d.chunkSize - 1) / d.chunkSize); workers > chunks {
+		workers = chunks
+	}
+
+	chunks := make(chan int64)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for start := range chunks {
+				end := start + d.chunkSize
+				if end > size {
+					end = size
+				}
+
+				var res *http.Response
+				if start == 0 {
+					res = first
+				}
+				if _, err := d.fetchSpan(ctx, dest, start, end, res); err != nil {
+					fail(err)
+					return
+				}
+			}
+		}()
+	}
+
+queue:
+	for start := int64(0); start < size; start += d.chunkSize {
+		select {
+		case chunks <- start:
+		case <-ctx.Done():
+			break queue
+		}
+	}
+	close(chunks)
+	wg.Wait()
+
+	if failure != nil {
+		return failure
+	}
+	return ctx.Err()
+}
+
+// fetch downloads the whole file into dest and returns its size
+func (d *urlDownload) fetch(ctx context.Context, dest *os.File) (int64, error) {
+	if d.connections > maxSlurpConnections {
+		d.connections = maxSlurpConnections
+	}
+
+	if d.connections > 1 {
+		// servers supporting ranges respond with only the first chunk,
+		// along with the size of the whole file
+		res, err := d.request(ctx, 0, d.chunkSize)
+		if err == nil {
+			if res.StatusCode == http.StatusPartialContent {
+				d.learn(res)
+				size, _, err := rangeSize(res)
+				if err != nil {
+					res.Body.Close()
+					return 0, err
+				}
+
+				if d.maxBytes > 0 && uint64(size) > d.maxBytes {
+					res.Body.Close()
+					return 0, limitExceeded("Content-Length is greater than max bytes (%d > %d)",
+						size, d.maxBytes)
+				}
+
+				return size, d.parallel(ctx, dest, size, res)
+			}
+
+			// the whole file is coming, over a single connection then
+			return d.sequential(ctx, dest, res)
+		}
+
+		loggerFrom(ctx).Warnf("Requesting the first chunk of %s failed, downloading it in one go: %s", d.url, err.Error())
+	}
+
+	return d.sequential(ctx, dest, nil)
+}
+
+// sequential downloads the whole file over a single connection, starting
+// from res if it was already requested
+func (d *urlDownload) sequential(ctx context.Context, dest *os.File, res *http.Response) (int64, error) {
+	size, err := d.fetchSpan(ctx, dest, 0, -1, res)
+	if err != nil {
+		return 0, err
+	}
+
+	// a restarted download may have been longer
+	return size, dest.Truncate(size)
+}
+
+// run downloads the file to a temporary file, and returns its name and
+// size. It's up to the caller to remove it.
+func (d *urlDownload) run(ctx context.Context) (_ string, _ uint64, err error) {
+	os.MkdirAll(tmpDir, os.ModeDir|0777)
+
+	// the same URL may be downloaded by several requests at once
+	dest, err := os.CreateTemp(tmpDir, "slurp_*")
+	if err != nil {
+		return "", 0, err
+	}
+
+	defer func() {
+		closeErr := dest.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(dest.Name())
+		}
+	}()
+
+	size, err := d.fetch(ctx, dest)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return dest.Name(), uint64(size), nil
+}
@@ -0,0 +1,121 @@
+package zipserver
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyServer serves data, dropping the connection halfway through the
+// first drops responses. Ranges are supported if ranges is true.
+type flakyServer struct {
+	data   []byte
+	ranges bool
+	drops  int
+
+	mutex    sync.Mutex
+	requests []string
+}
+
+func (fs *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fs.mutex.Lock()
+	fs.requests = append(fs.requests, r.Header.Get("Range"))
+	drop := fs.drops > 0
+	fs.drops--
+	fs.mutex.Unlock()
+
+	if drop {
+		w.Header().Set("Content-Length", "999999999")
+		w.WriteHeader(http.StatusOK)
+		w.Write(fs.data[:len(fs.data)/2])
+		panic(http.ErrAbortHandler)
+	}
+
+	if fs.ranges {
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(fs.data))
+		return
+	}
+	w.Write(fs.data)
+}
+
+func Test_URLDownload(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+	config.SlurpAttempts = 3
+	config.SlurpChunkSize = rangeBlockSize
+
+	data := randomBytes(t, rangeBlockSize*5+1000)
+
+	download := func(server *flakyServer, connections int, maxBytes uint64) ([]byte, error) {
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+
+		d := newURLDownload(config, ts.URL, nil, maxBytes, "slurp")
+		d.connections = connections
+		fname, size, err := d.run(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(fname)
+
+		contents, err := os.ReadFile(fname)
+		assert.NoError(t, err)
+		assert.EqualValues(t, size, len(contents))
+		return contents, nil
+	}
+
+	// resumed where the connection dropped
+	server := &flakyServer{data: data, ranges: true, drops: 1}
+	contents, err := download(server, 1, 0)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, contents))
+	assert.EqualValues(t, []string{"", "bytes=328180-"}, server.requests)
+
+	// restarted when ranges aren't supported
+	server = &flakyServer{data: data, drops: 2}
+	contents, err = download(server, 1, 0)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, contents))
+	assert.EqualValues(t, 3, len(server.requests))
+
+	server = &flakyServer{data: data, drops: 3}
+	_, err = download(server, 1, 0)
+	assert.Error(t, err, "gives up after SlurpAttempts")
+
+	// in chunks
+	server = &flakyServer{data: data, ranges: true}
+	contents, err = download(server, 4, 0)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, contents))
+	assert.EqualValues(t, 6, len(server.requests))
+	assert.Contains(t, server.requests, "bytes=655360-656359")
+
+	// a single connection when ranges aren't supported
+	server = &flakyServer{data: data}
+	contents, err = download(server, 4, 0)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, contents))
+	assert.EqualValues(t, 1, len(server.requests))
+
+	// limits
+	server = &flakyServer{data: data, ranges: true}
+	_, err = download(server, 1, 1000)
+	assert.EqualValues(t, http.StatusUnprocessableEntity, statusCodeFor(err))
+
+	_, err = download(server, 4, 1000)
+	assert.EqualValues(t, http.StatusUnprocessableEntity, statusCodeFor(err))
+
+	// not worth retrying
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+	_, _, err = newURLDownload(config, ts.URL, nil, 0, "slurp").run(ctx)
+	assert.EqualError(t, err, "Failed to fetch file: 404")
+}
@@ -0,0 +1,101 @@
+package zipserver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+
+	errors "github.com/go-errors/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// SlurpedZip is the zip SlurpExtract downloaded
+type SlurpedZip struct {
+	URL string
+	// where the zip was stored, empty if it wasn't
+	Key  string `json:",omitempty"`
+	Size uint64
+}
+
+// SlurpExtractResult reports both stages of SlurpExtract
+type SlurpExtractResult struct {
+	// set once the zip is downloaded, and stored if asked to
+	Slurped        *SlurpedZip
+	ExtractedFiles []ExtractedFile
+}
+
+// downloadZip downloads zipURL to a temporary file, failing if it's larger
+// than maxBytes (0 for no limit)
+func (a *Archiver) downloadZip(ctx context.Context, zipURL string, headers map[string]string, maxBytes uint64) (_ string, _ uint64, err error) {
+	ctx, span := startSpan(ctx, "Archiver.downloadZip", attribute.String("slurp.url", zipURL))
+	defer func() { endSpan(span, err) }()
+
+	fname, size, err := newURLDownload(a.Config, zipURL, headers, maxBytes, "slurp_extract").run(ctx)
+	if err != nil {
+		return "", 0, errors.Wrap(err, 0)
+	}
+
+	span.SetAttributes(attribute.Int64("zip.size", int64(size)))
+	return fname, size, nil
+}
+
+// storeZip uploads the downloaded zip at fname to key
+func (a *Archiver) storeZip(ctx context.Context, fname, key string, size uint64) error {
+	// seekable, so failed uploads are retried from the file
+	file, err := os.Open(fname)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	defer file.Close()
+
+	err = a.Storage.PutFile(ctx, a.Bucket, key, file, "application/zip")
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	metrics.uploadedBytes.WithLabelValues("slurp_extract").Add(float64(size))
+	return nil
+}
+
+// SlurpExtract downloads the zip at zipURL, stores it at key unless key is
+// empty, then extracts it to prefix like ExtractZip would. The download and
+// storing the zip are subject to the download timeout in limits, and fail if
+// the zip is larger than maxBytes (0 for no limit).
+//
+// The result is returned even on failure: its Slurped field tells whether the
+// zip was downloaded (and stored) before things went wrong.
+func (a *Archiver) SlurpExtract(ctx context.Context, zipURL string, headers map[string]string, maxBytes uint64, key, prefix string, limits *ExtractLimits) (_ *SlurpExtractResult, err error) {
+	ctx, span := startSpan(ctx, "Archiver.SlurpExtract",
+		attribute.String("slurp.url", zipURL), attribute.String("extract.prefix", prefix))
+	defer func() { endSpan(span, err) }()
+
+	result := &SlurpExtractResult{}
+
+	downloadCtx, stop := withTimeout(ctx, "download", limits.DownloadTimeout)
+	fname, size, err := a.downloadZip(downloadCtx, zipURL, headers, maxBytes)
+	if err == nil {
+		defer os.Remove(fname)
+
+		if key != "" {
+			loggerFrom(ctx).Infof("Storing %s (size: %d) to %s", zipURL, size, key)
+			err = a.storeZip(downloadCtx, fname, key, size)
+		}
+	}
+	stop()
+	if err != nil {
+		if ctx.Err() != nil {
+			return result, errors.Wrap(fmt.Errorf("Slurp aborted: %w", abortReason(ctx)), 0)
+		}
+		return result, errors.Wrap(timedOut(ctx, downloadCtx, err), 0)
+	}
+
+	result.Slurped = &SlurpedZip{URL: zipURL, Key: key, Size: size}
+
+	result.ExtractedFiles, err = a.sendZipExtracted(ctx, path.Join(a.ExtractPrefix, prefix), fname, limits)
+	if err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,82 @@
+package zipserver
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// slurpExtractErrorKind tells which stage of a slurp and extract failed
+func slurpExtractErrorKind(result *SlurpExtractResult) string {
+	if result.Slurped == nil {
+		return "SlurpError"
+	}
+	return "ExtractError"
+}
+
+func slurpExtractHandler(w http.ResponseWriter, r *http.Request) error {
+	req, err := parseSlurpExtractRequest(r)
+	if err != nil {
+		return err
+	}
+
+	limits := req.Limits.limits(config)
+	limits.OnlyFiles = req.Files
+	maxBytes := req.maxBytes(config)
+
+	process := func(ctx context.Context) (interface{}, error) {
+		defer trackInFlight("slurp_extract")()
+
+		// extractions to the same prefix wait for each other
+		if err := lockPrefix(ctx, req.Prefix); err != nil {
+			metrics.operations.WithLabelValues("slurp_extract", outcomeLabel(err)).Inc()
+			return nil, err
+		}
+		defer releasePrefix(req.Prefix)
+
+		ctx, stop := withTimeout(ctx, "slurp_extract", limits.JobTimeout)
+		defer stop()
+
+		loggerFrom(ctx).Infof("Fetching %s to extract to %s", req.URL, req.Prefix)
+
+		archiver := NewArchiver(config)
+		result, err := archiver.SlurpExtract(ctx, req.URL, req.Headers, maxBytes, req.Key, req.Prefix, limits)
+		metrics.operations.WithLabelValues("slurp_extract", outcomeLabel(err)).Inc()
+		if err != nil {
+			if result.Slurped == nil {
+				return nil, err
+			}
+			// the client still learns where the zip was stored
+			return slurpExtractFailure{result.Slurped}, &jobError{slurpExtractErrorKind(result), err}
+		}
+		return result, nil
+	}
+
+	return runJob(w, r, req.Callback.URL, "SlurpError", process,
+		func(values url.Values, result interface{}) {
+			switch result := result.(type) {
+			case *SlurpExtractResult:
+				addSlurpedValues(values, result.Slurped)
+				addExtractedFilesValues(values, result.ExtractedFiles)
+			case slurpExtractFailure:
+				addSlurpedValues(values, result.Slurped)
+			}
+		})
+}
+
+// slurpExtractFailure is what's reported of a slurp and extract that failed
+// after downloading the zip
+type slurpExtractFailure struct {
+	Slurped *SlurpedZip
+}
+
+// addSlurpedValues describes the downloaded zip in the values posted to
+// async callbacks
+func addSlurpedValues(values url.Values, slurped *SlurpedZip) {
+	values.Add("Slurped[URL]", slurped.URL)
+	if slurped.Key != "" {
+		values.Add("Slurped[Key]", slurped.Key)
+	}
+	values.Add("Slurped[Size]", strconv.FormatUint(slurped.Size, 10))
+}
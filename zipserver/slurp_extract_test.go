@@ -0,0 +1,102 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SlurpExtract(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+	config.ExtractPrefix = "extracted"
+	storage, err := NewMemStorage()
+	assert.NoError(t, err)
+	archiver := &Archiver{storage, config}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	zl := &zipLayout{
+		entries: []zipEntry{
+			zipEntry{name: "index.html", data: []byte("<!doctype html><html></html>")},
+			zipEntry{name: "js/game.js", data: []byte("console.log('hi')")},
+		},
+	}
+	zl.Write(t, zw)
+	assert.NoError(t, zw.Close())
+	zipData := buf.Bytes()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write(zipData)
+	}))
+	defer server.Close()
+	headers := map[string]string{"Authorization": "Bearer secret"}
+
+	result, err := archiver.SlurpExtract(ctx, server.URL, headers, 0, "zips/game.zip", "games/1", testLimits())
+	assert.NoError(t, err)
+	assert.EqualValues(t, &SlurpedZip{URL: server.URL, Key: "zips/game.zip", Size: uint64(len(zipData))}, result.Slurped)
+	assert.EqualValues(t, 2, len(result.ExtractedFiles))
+
+	reader, err := storage.GetFile(ctx, config.Bucket, "zips/game.zip")
+	assert.NoError(t, err)
+	stored, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.EqualValues(t, zipData, stored)
+
+	reader, err = storage.GetFile(ctx, config.Bucket, "extracted/games/1/js/game.js")
+	assert.NoError(t, err)
+	contents, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "console.log('hi')", string(contents))
+
+	// without storing the zip, only some files
+	limits := testLimits()
+	limits.OnlyFiles = []string{"index.html"}
+	result, err = archiver.SlurpExtract(ctx, server.URL, headers, 0, "", "games/2", limits)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "", result.Slurped.Key)
+	assert.EqualValues(t, []ExtractedFile{{Key: "extracted/games/2/index.html", Size: 28}}, result.ExtractedFiles)
+
+	// download failures
+	result, err = archiver.SlurpExtract(ctx, server.URL, nil, 0, "zips/nope.zip", "games/3", testLimits())
+	assert.Error(t, err)
+	assert.Nil(t, result.Slurped)
+	assert.EqualValues(t, "SlurpError", slurpExtractErrorKind(result))
+
+	result, err = archiver.SlurpExtract(ctx, server.URL, headers, 100, "zips/big.zip", "games/3", testLimits())
+	assert.EqualValues(t, http.StatusUnprocessableEntity, statusCodeFor(err))
+	assert.Nil(t, result.Slurped)
+	_, err = storage.GetFile(ctx, config.Bucket, "zips/big.zip")
+	assert.Error(t, err, "nothing is stored when the download fails")
+
+	// extraction failures, the zip is still stored
+	limits = testLimits()
+	limits.MaxNumFiles = 1
+	result, err = archiver.SlurpExtract(ctx, server.URL, headers, 0, "zips/again.zip", "games/4", limits)
+	assert.EqualValues(t, http.StatusUnprocessableEntity, statusCodeFor(err))
+	assert.NotNil(t, result.Slurped)
+	assert.EqualValues(t, "ExtractError", slurpExtractErrorKind(result))
+	_, err = storage.GetFile(ctx, config.Bucket, "zips/again.zip")
+	assert.NoError(t, err)
+
+	// the zip size is bounded by config, callers can only lower it
+	config.MaxInputZipSize = 1000
+	req := &SlurpExtractRequest{}
+	assert.EqualValues(t, 1000, req.maxBytes(config))
+	req.MaxBytes = 100
+	assert.EqualValues(t, 100, req.maxBytes(config))
+	req.MaxBytes = 5000
+	assert.EqualValues(t, 1000, req.maxBytes(config))
+	config.MaxInputZipSize = 0
+	assert.EqualValues(t, 5000, req.maxBytes(config))
+}
@@ -1,86 +1,103 @@
 package zipserver
 
 import (
+	"context"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"os"
 	"strconv"
 )
 
-func slurpHandler(w http.ResponseWriter, r *http.Request) error {
-	params := r.URL.Query()
+// SlurpResult describes a slurped file, as it was stored
+type SlurpResult struct {
+	Size    uint64
+	Digests Digests
+}
 
-	key, err := getParam(params, "key")
+func slurpHandler(w http.ResponseWriter, r *http.Request) error {
+	slurpReq, err := parseSlurpRequest(r)
 	if err != nil {
 		return err
 	}
 
-	slurpURL, err := getParam(params, "url")
-	if err != nil {
-		return err
-	}
+	key := slurpReq.Key
+	slurpURL := slurpReq.URL
+	contentType := slurpReq.ContentType
+	maxBytes := slurpReq.MaxBytes
+	acl := slurpReq.ACL
+	contentDisposition := slurpReq.ContentDisposition
 
-	contentType := params.Get("content_type")
-	maxBytesStr := params.Get("max_bytes")
-	acl := params.Get("acl")
-	contentDisposition := params.Get("content_disposition")
+	timeout := seconds(config.JobTimeout)
+	if slurpReq.Timeout != nil {
+		timeout = seconds(*slurpReq.Timeout)
+	}
 
-	var maxBytes uint64
-	if maxBytesStr != "" {
-		maxBytes, err = strconv.ParseUint(maxBytesStr, 10, 64)
-		if err != nil {
-			return err
-		}
+	downloadTimeout := seconds(config.DownloadTimeout)
+	if slurpReq.DownloadTimeout != nil {
+		downloadTimeout = seconds(*slurpReq.DownloadTimeout)
 	}
 
-	process := func() error {
-		log.Print("Fetching URL: ", slurpURL)
-		client := http.Client{}
-		res, err := client.Get(slurpURL)
+	process := func(ctx context.Context) (*SlurpResult, error) {
+		logger := loggerFrom(ctx)
+		logger.Infof("Fetching URL: %s", slurpURL)
 
-		if err != nil {
-			return err
-		}
+		// the file is spooled to disk, then uploaded: both have to fit in
+		// the download timeout
+		parentCtx := ctx
+		ctx, stop := withTimeout(ctx, "download", downloadTimeout)
+		defer stop()
 
-		defer res.Body.Close()
+		download := newURLDownload(config, slurpURL, slurpReq.Headers, maxBytes, "slurp")
+		if slurpReq.Connections != nil {
+			download.connections = *slurpReq.Connections
+		}
 
-		if res.StatusCode != 200 {
-			return fmt.Errorf("Failed to fetch file: %d", res.StatusCode)
+		fname, size, err := download.run(ctx)
+		if err != nil {
+			return nil, timedOut(parentCtx, ctx, err)
 		}
+		defer os.Remove(fname)
 
 		if contentType == "" {
-			contentType = res.Header.Get("Content-Type")
+			contentType = download.contentType
 		}
 
 		if contentType == "" {
 			contentType = "application/octet-stream"
 		}
 
-		body := io.Reader(res.Body)
+		// checked before uploading, so a bad download never replaces what's
+		// stored at key
+		digests, err := fileDigests(ctx, fname)
+		if err != nil {
+			return nil, timedOut(parentCtx, ctx, err)
+		}
 
-		if maxBytes > 0 {
-			if uint64(res.ContentLength) > maxBytes {
-				return fmt.Errorf("Content-Length is greater than max bytes (%d > %d)",
-					res.ContentLength, maxBytes)
-			}
+		err = slurpReq.Checksums.verify(digests)
+		if err != nil {
+			return nil, err
+		}
 
-			var bytesRead uint64
-			body = limitedReader(body, maxBytes, &bytesRead)
+		// seekable, so failed uploads are retried from the file
+		body, err := os.Open(fname)
+		if err != nil {
+			return nil, err
 		}
+		defer body.Close()
 
-		log.Print("Uploading ", contentType, " (size: ", res.ContentLength, ") to ", key)
-		log.Print("ACL: ", acl)
-		log.Print("Content-Disposition: ", contentDisposition)
+		logger.Infof("Uploading %s (size: %d) to %s", contentType, size, key)
+		logger.Infof("ACL: %s", acl)
+		logger.Infof("Content-Disposition: %s", contentDisposition)
 
-		storage, err := NewGcsStorage(config)
+		storage, err := newStorage(config)
 
 		if storage == nil {
-			log.Fatal("Failed to create storage:", err)
+			log.Fatal("Failed to create storage: ", err)
 		}
 
-		return storage.PutFileWithSetup(config.Bucket, key, body, func(req *http.Request) error {
+		err = storage.PutFileWithSetup(ctx, config.Bucket, key, body, func(req *http.Request) error {
 			req.Header.Add("Content-Type", contentType)
 
 			if contentDisposition != "" {
@@ -88,42 +105,45 @@ func slurpHandler(w http.ResponseWriter, r *http.Request) error {
 			}
 
 			req.Header.Add("x-goog-acl", acl)
+
+			for name, value := range slurpReq.Metadata {
+				req.Header.Add("x-goog-meta-"+name, value)
+			}
 			return nil
 		})
-	}
-
-	asyncURL := params.Get("async")
-	if asyncURL == "" {
-		err = process()
 		if err != nil {
-			return writeJSONError(w, "SlurpError", err)
+			return nil, timedOut(parentCtx, ctx, err)
 		}
 
-		return writeJSONMessage(w, struct {
-			Success bool
-		}{true})
+		metrics.uploadedBytes.WithLabelValues("slurp").Add(float64(size))
+
+		return &SlurpResult{Size: size, Digests: digests}, nil
 	}
 
-	go (func() {
-		err = process()
-		log.Print("Notifying " + asyncURL)
+	// counts the slurp in metrics, whichever codepath it takes
+	instrumentedProcess := func(ctx context.Context) (interface{}, error) {
+		defer trackInFlight("slurp")()
 
-		resValues := url.Values{}
-		if err != nil {
-			resValues.Add("Type", "SlurpError")
-			resValues.Add("Error", err.Error())
-		} else {
-			resValues.Add("Success", "true")
-		}
+		ctx, stop := withTimeout(ctx, "slurp", timeout)
+		defer stop()
 
-		_, err = http.PostForm(asyncURL, resValues)
+		result, err := process(ctx)
+		if err != nil && ctx.Err() != nil {
+			err = fmt.Errorf("Slurp aborted: %w", abortReason(ctx))
+		}
+		metrics.operations.WithLabelValues("slurp", outcomeLabel(err)).Inc()
 		if err != nil {
-			log.Print("Failed to deliver callback: " + err.Error())
+			return nil, err
 		}
-	})()
+		return result, nil
+	}
 
-	return writeJSONMessage(w, struct {
-		Processing bool
-		Async      bool
-	}{true, true})
+	return runJob(w, r, slurpReq.Callback.URL, "SlurpError", instrumentedProcess,
+		func(values url.Values, result interface{}) {
+			slurped := result.(*SlurpResult)
+			values.Add("Size", strconv.FormatUint(slurped.Size, 10))
+			values.Add("Digests[SHA256]", slurped.Digests.SHA256)
+			values.Add("Digests[MD5]", slurped.Digests.MD5)
+			values.Add("Digests[CRC32C]", slurped.Digests.CRC32C)
+		})
 }
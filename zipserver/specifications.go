@@ -2,6 +2,7 @@ package zipserver
 
 import (
 	"fmt"
+	"mime"
 	"net/http"
 	"path"
 	"strings"
@@ -16,6 +17,58 @@ type ResourceSpec struct {
 	contentEncoding string
 }
 
+// sniffLen is how many bytes of a file newResourceSpec looks at
+const sniffLen = 512
+
+// newResourceSpec works out how a file should be stored under key, given the
+// first bytes of its contents (up to sniffLen): its MIME type, its encoding,
+// and the key it really goes to once rewrite rules are applied
+func newResourceSpec(key string, head []byte) *ResourceSpec {
+	resource := &ResourceSpec{
+		key: key,
+	}
+
+	// try determining MIME by extension
+	mimeType := mime.TypeByExtension(path.Ext(key))
+
+	contentMimeType := http.DetectContentType(head)
+
+	if contentMimeType == "application/x-gzip" || contentMimeType == "application/gzip" {
+		resource.contentEncoding = "gzip"
+
+		// try to see if there's a real extension hidden beneath
+		if strings.HasSuffix(key, ".gz") {
+			realMimeType := mime.TypeByExtension(path.Ext(strings.TrimSuffix(key, ".gz")))
+
+			if realMimeType != "" {
+				mimeType = realMimeType
+			}
+		}
+
+	} else if strings.HasSuffix(key, ".br") {
+		// there is no way to detect a brotli stream by content, so we assume if it ends if .br then it's brotli
+		// this path is used for Unity 2020 webgl games built with brotli compression
+		resource.contentEncoding = "br"
+		realMimeType := mime.TypeByExtension(path.Ext(strings.TrimSuffix(key, ".br")))
+
+		if realMimeType != "" {
+			mimeType = realMimeType
+		}
+	} else if mimeType == "" {
+		// fall back to the extension detected from content, eg. someone uploaded a .png with wrong extension
+		mimeType = contentMimeType
+	}
+
+	if mimeType == "" {
+		// default mime type
+		mimeType = "application/octet-stream"
+	}
+	resource.contentType = mimeType
+
+	resource.applyRewriteRules()
+	return resource
+}
+
 func (rs *ResourceSpec) String() string {
 	formattedEncoding := ""
 	if rs.contentEncoding != "" {
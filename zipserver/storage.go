@@ -1,6 +1,8 @@
 package zipserver
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net/http"
 )
@@ -10,8 +12,123 @@ type StorageSetupFunc func(*http.Request) error
 
 // Storage is a place we can get files from, put files into, or delete files from
 type Storage interface {
-	GetFile(bucket, key string) (io.ReadCloser, error)
-	PutFile(bucket, key string, contents io.Reader, mimeType string) error
-	PutFileWithSetup(bucket, key string, contents io.Reader, setup StorageSetupFunc) error
-	DeleteFile(bucket, key string) error
+	GetFile(ctx context.Context, bucket, key string) (io.ReadCloser, error)
+	// GetFileRange reads length bytes of bucket/key from offset, or its last
+	// length bytes if offset is negative, and returns the size of all of it
+	GetFileRange(ctx context.Context, bucket, key string, offset, length int64) (io.ReadCloser, int64, error)
+	PutFile(ctx context.Context, bucket, key string, contents io.Reader, mimeType string) error
+	PutFileWithSetup(ctx context.Context, bucket, key string, contents io.Reader, setup StorageSetupFunc) error
+	DeleteFile(ctx context.Context, bucket, key string) error
+	// ListFiles returns the objects whose key starts with prefix, by key
+	ListFiles(ctx context.Context, bucket, prefix string) ([]StorageObject, error)
+}
+
+// StorageObject is an object listed from storage
+type StorageObject struct {
+	Key  string
+	Size uint64
+}
+
+// StorageErrorKind classifies storage errors so callers can act on them
+type StorageErrorKind string
+
+// Kinds of storage errors
+const (
+	StorageNotFound           StorageErrorKind = "NotFound"
+	StoragePermissionDenied   StorageErrorKind = "PermissionDenied"
+	StoragePreconditionFailed StorageErrorKind = "PreconditionFailed"
+	// worth retrying: server errors, rate limiting, timeouts
+	StorageTransient StorageErrorKind = "Transient"
+	StorageUnknown   StorageErrorKind = "Unknown"
+)
+
+// storageErrorKindFor classifies an HTTP status code
+func storageErrorKindFor(statusCode int) StorageErrorKind {
+	switch {
+	case statusCode == http.StatusNotFound:
+		return StorageNotFound
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return StoragePermissionDenied
+	case statusCode == http.StatusPreconditionFailed:
+		return StoragePreconditionFailed
+	case statusCode >= 500 || statusCode == http.StatusTooManyRequests || statusCode == http.StatusRequestTimeout:
+		return StorageTransient
+	default:
+		return StorageUnknown
+	}
+}
+
+// StorageError is returned when storage responds with an unexpected HTTP
+// status. Code and Message come from the error body, if there was one.
+type StorageError struct {
+	Kind       StorageErrorKind
+	StatusCode int
+	Status     string
+	URL        string
+	Code       string
+	Message    string
+}
+
+func newStorageError(statusCode int, status, url string) *StorageError {
+	return &StorageError{
+		Kind:       storageErrorKindFor(statusCode),
+		StatusCode: statusCode,
+		Status:     status,
+		URL:        url,
+	}
+}
+
+func (se *StorageError) Error() string {
+	msg := se.Status + " " + se.URL
+	if se.Code != "" {
+		msg += ": " + se.Code
+	}
+	if se.Message != "" {
+		msg += ": " + se.Message
+	}
+	return msg
+}
+
+// storageErrorDetails is what API consumers get to see of a StorageError
+type storageErrorDetails struct {
+	Kind       StorageErrorKind
+	StatusCode int
+	Code       string `json:",omitempty"`
+	Message    string `json:",omitempty"`
+}
+
+// storageErrorDetailsOf returns details about the StorageError in err's
+// chain, or nil if there's none
+func storageErrorDetailsOf(err error) *storageErrorDetails {
+	var se *StorageError
+	if !errors.As(err, &se) {
+		return nil
+	}
+
+	return &storageErrorDetails{
+		Kind:       se.Kind,
+		StatusCode: se.StatusCode,
+		Code:       se.Code,
+		Message:    se.Message,
+	}
+}
+
+// isStorageNotFound returns true if err says the object doesn't exist
+func isStorageNotFound(err error) bool {
+	var se *StorageError
+	return errors.As(err, &se) && se.Kind == StorageNotFound
+}
+
+// newStorage returns the storage zipserver works with for a given config:
+// GCS, retrying failed calls, instrumented for metrics and tracing
+func newStorage(config *Config) (Storage, error) {
+	gcs, err := NewGcsStorage(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// every attempt gets traced, metrics only count failures after retries
+	var storage Storage = &tracedStorage{gcs}
+	storage = newRetryingStorage(storage, config)
+	return &instrumentedStorage{storage}, nil
 }
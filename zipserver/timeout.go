@@ -0,0 +1,79 @@
+package zipserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// TimeoutError is the reason an operation was aborted when it took longer
+// than it was allowed to
+type TimeoutError struct {
+	// what timed out: extraction, slurp, download, upload
+	Operation string
+	Timeout   time.Duration
+}
+
+func (te *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %s", te.Operation, te.Timeout)
+}
+
+// timeoutDetails is what API consumers get to see of a TimeoutError
+type timeoutDetails struct {
+	Operation string
+	Seconds   float64
+}
+
+// timeoutDetailsOf returns details about the TimeoutError in err's chain, or
+// nil if there's none
+func timeoutDetailsOf(err error) *timeoutDetails {
+	var te *TimeoutError
+	if !errors.As(err, &te) {
+		return nil
+	}
+
+	return &timeoutDetails{
+		Operation: te.Operation,
+		Seconds:   te.Timeout.Seconds(),
+	}
+}
+
+// withTimeout returns a copy of ctx that's aborted with a TimeoutError for
+// operation after timeout, along with a function releasing it that must be
+// called once the operation is done. A timeout of 0 means no limit.
+func withTimeout(ctx context.Context, operation string, timeout time.Duration) (context.Context, func()) {
+	ctx, abort := withAbort(ctx)
+	if timeout <= 0 {
+		return ctx, func() { abort(nil) }
+	}
+
+	timer := time.AfterFunc(timeout, func() {
+		abort(&TimeoutError{operation, timeout})
+	})
+
+	return ctx, func() {
+		timer.Stop()
+		abort(nil)
+	}
+}
+
+// timedOut returns the TimeoutError ctx was aborted with, if err happened
+// because of it, and err otherwise. parent is the context the timeout was
+// set up from: if it was aborted too, that's not a timeout of ours.
+func timedOut(parent, ctx context.Context, err error) error {
+	if err == nil || parent.Err() != nil {
+		return err
+	}
+
+	var te *TimeoutError
+	if errors.As(abortReason(ctx), &te) {
+		return te
+	}
+	return err
+}
+
+// seconds turns a config or query param value into a duration
+func seconds(s int) time.Duration {
+	return time.Duration(s) * time.Second
+}
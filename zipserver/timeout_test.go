@@ -0,0 +1,99 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_WithTimeout(t *testing.T) {
+	ctx, stop := withTimeout(context.Background(), "upload", 10*time.Millisecond)
+	defer stop()
+
+	<-ctx.Done()
+	err := timedOut(context.Background(), ctx, ctx.Err())
+	assert.EqualError(t, err, "upload timed out after 10ms")
+
+	details := timeoutDetailsOf(err)
+	if assert.NotNil(t, details) {
+		assert.EqualValues(t, "upload", details.Operation)
+		assert.EqualValues(t, 0.01, details.Seconds)
+	}
+
+	values := url.Values{}
+	addErrorValues(values, "ExtractError", err)
+	assert.EqualValues(t, "upload", values.Get("Timeout[Operation]"))
+	assert.EqualValues(t, "0.01", values.Get("Timeout[Seconds]"))
+
+	// the parent being aborted isn't a timeout of ours
+	parent, abort := withAbort(context.Background())
+	ctx, stop = withTimeout(parent, "upload", time.Hour)
+	defer stop()
+	abort(errCanceled)
+	err = timedOut(parent, ctx, ctx.Err())
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, errCanceled, abortReason(ctx))
+
+	// no timeout at all
+	ctx, stop = withTimeout(context.Background(), "upload", 0)
+	_, hasDeadline := ctx.Deadline()
+	assert.False(t, hasDeadline)
+	assert.NoError(t, ctx.Err())
+	stop()
+}
+
+func Test_ExtractTimeouts(t *testing.T) {
+	config := emptyConfig()
+
+	storage, err := NewMemStorage()
+	assert.NoError(t, err)
+	storage.stallPuts("zipserver_test/")
+
+	archiver := &Archiver{storage, config}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	zl := &zipLayout{
+		entries: []zipEntry{
+			zipEntry{name: "1", data: []byte("uh oh")},
+		},
+	}
+	zl.Write(t, zw)
+	assert.NoError(t, zw.Close())
+
+	fname := filepath.Join(t.TempDir(), "timeout.zip")
+	assert.NoError(t, os.WriteFile(fname, buf.Bytes(), 0644))
+
+	// a single upload stalls
+	limits := testLimits()
+	limits.FileTimeout = 50 * time.Millisecond
+
+	_, err = archiver.sendZipExtracted(context.Background(), "zipserver_test/timeout", fname, limits)
+	assert.Error(t, err)
+	details := timeoutDetailsOf(err)
+	if assert.NotNil(t, details) {
+		assert.EqualValues(t, "upload", details.Operation)
+	}
+
+	// the whole job takes too long
+	limits = testLimits()
+	ctx, stop := withTimeout(context.Background(), "extraction", 50*time.Millisecond)
+	defer stop()
+
+	_, err = archiver.sendZipExtracted(ctx, "zipserver_test/timeout", fname, limits)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Extraction aborted: extraction timed out after 50ms")
+	details = timeoutDetailsOf(err)
+	if assert.NotNil(t, details) {
+		assert.EqualValues(t, "extraction", details.Operation)
+	}
+
+	assert.EqualValues(t, 0, len(storage.objects))
+}
@@ -0,0 +1,141 @@
+package zipserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/itchio/zipserver"
+
+// SetupTracing exports traces to the OTLP/HTTP collector at
+// config.OTLPEndpoint, and picks up trace context from incoming requests.
+// The returned function flushes pending spans, it must be called before
+// exiting. Without an endpoint, tracing is a no-op.
+func SetupTracing(config *Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	if config.OTLPEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	endpoint, err := url.Parse(config.OTLPEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid OTLPEndpoint: %s", err.Error())
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint.Host)}
+	if endpoint.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if endpoint.Path != "" && endpoint.Path != "/" {
+		opts = append(opts, otlptracehttp.WithURLPath(endpoint.Path))
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceNameKey.String("zipserver"),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// startSpan starts a span as a child of whatever span ctx carries
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err (if any) on span, then ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracedStorage records a span for every call to the underlying storage
+type tracedStorage struct {
+	Storage
+}
+
+// interface guard
+var _ Storage = (*tracedStorage)(nil)
+
+func storageSpan(ctx context.Context, operation, bucket, key string) (context.Context, trace.Span) {
+	return startSpan(ctx, "Storage."+operation,
+		attribute.String("storage.bucket", bucket),
+		attribute.String("storage.key", key),
+	)
+}
+
+// GetFile implements Storage.GetFile for tracedStorage
+func (ts *tracedStorage) GetFile(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	ctx, span := storageSpan(ctx, "GetFile", bucket, key)
+	reader, err := ts.Storage.GetFile(ctx, bucket, key)
+	endSpan(span, err)
+	return reader, err
+}
+
+// GetFileRange implements Storage.GetFileRange for tracedStorage
+func (ts *tracedStorage) GetFileRange(ctx context.Context, bucket, key string, offset, length int64) (io.ReadCloser, int64, error) {
+	ctx, span := storageSpan(ctx, "GetFileRange", bucket, key)
+	reader, size, err := ts.Storage.GetFileRange(ctx, bucket, key, offset, length)
+	endSpan(span, err)
+	return reader, size, err
+}
+
+// PutFile implements Storage.PutFile for tracedStorage
+func (ts *tracedStorage) PutFile(ctx context.Context, bucket, key string, contents io.Reader, mimeType string) error {
+	ctx, span := storageSpan(ctx, "PutFile", bucket, key)
+	err := ts.Storage.PutFile(ctx, bucket, key, contents, mimeType)
+	endSpan(span, err)
+	return err
+}
+
+// PutFileWithSetup implements Storage.PutFileWithSetup for tracedStorage
+func (ts *tracedStorage) PutFileWithSetup(ctx context.Context, bucket, key string, contents io.Reader, setup StorageSetupFunc) error {
+	ctx, span := storageSpan(ctx, "PutFileWithSetup", bucket, key)
+	err := ts.Storage.PutFileWithSetup(ctx, bucket, key, contents, setup)
+	endSpan(span, err)
+	return err
+}
+
+// DeleteFile implements Storage.DeleteFile for tracedStorage
+func (ts *tracedStorage) DeleteFile(ctx context.Context, bucket, key string) error {
+	ctx, span := storageSpan(ctx, "DeleteFile", bucket, key)
+	err := ts.Storage.DeleteFile(ctx, bucket, key)
+	endSpan(span, err)
+	return err
+}
+
+// ListFiles implements Storage.ListFiles for tracedStorage
+func (ts *tracedStorage) ListFiles(ctx context.Context, bucket, prefix string) ([]StorageObject, error) {
+	ctx, span := storageSpan(ctx, "ListFiles", bucket, prefix)
+	objects, err := ts.Storage.ListFiles(ctx, bucket, prefix)
+	endSpan(span, err)
+	return objects, err
+}
@@ -0,0 +1,115 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpCollector is an in-process OTLP/HTTP collector that remembers the
+// spans it receives
+type otlpCollector struct {
+	sync.Mutex
+	spans map[string][]byte // name => trace ID
+}
+
+func (oc *otlpCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	var req collectortrace.ExportTraceServiceRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	oc.Lock()
+	defer oc.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, span := range ss.Spans {
+				oc.spans[span.Name] = span.TraceId
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	resBody, _ := proto.Marshal(&collectortrace.ExportTraceServiceResponse{})
+	w.Write(resBody)
+}
+
+func Test_Tracing(t *testing.T) {
+	collector := &otlpCollector{spans: make(map[string][]byte)}
+	ts := httptest.NewServer(collector)
+	defer ts.Close()
+
+	previousProvider := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(previousProvider)
+
+	shutdown, err := SetupTracing(&Config{OTLPEndpoint: ts.URL})
+	assert.NoError(t, err)
+
+	memStorage, err := NewMemStorage()
+	assert.NoError(t, err)
+	storage := &tracedStorage{memStorage}
+	config := emptyConfig()
+	archiver := &Archiver{storage, config}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	writer, err := zw.Create("file.txt")
+	assert.NoError(t, err)
+	writer.Write([]byte("Hello there"))
+	assert.NoError(t, zw.Close())
+
+	err = memStorage.PutFile(context.Background(), config.Bucket, "trace.zip", &buf, "application/zip")
+	assert.NoError(t, err)
+
+	// pretend we're extracting on behalf of a traced request
+	traceparent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	req := httptest.NewRequest("GET", "/extract?key=trace.zip&prefix=traced", nil)
+	req.Header.Set("traceparent", traceparent)
+
+	var handlerTraceID trace.TraceID
+	handler := errorHandler(func(w http.ResponseWriter, r *http.Request) error {
+		handlerTraceID = trace.SpanFromContext(r.Context()).SpanContext().TraceID()
+
+		ctx := jobContext(context.Background(), r, "test")
+		_, err := archiver.ExtractZip(ctx, "trace.zip", "traced", testLimits())
+		return err
+	})
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.EqualValues(t, "0af7651916cd43dd8448eb211c80319c", handlerTraceID.String(), "incoming trace context should be picked up")
+
+	assert.NoError(t, shutdown(context.Background()))
+
+	collector.Lock()
+	defer collector.Unlock()
+	for _, name := range []string{
+		"/extract",
+		"Archiver.fetchZip",
+		"Archiver.sendZipExtracted",
+		"Archiver.extractAndUploadOne",
+		"Storage.GetFile",
+		"Storage.PutFileWithSetup",
+	} {
+		traceID, ok := collector.spans[name]
+		if assert.True(t, ok, "collector should have received span %s", name) {
+			assert.EqualValues(t, handlerTraceID[:], traceID, "span %s should be part of the request's trace", name)
+		}
+	}
+}